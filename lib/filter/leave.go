@@ -0,0 +1,81 @@
+package filter
+
+import "os"
+
+import "oddcomm/src/core"
+
+
+var partIn, partOut filterList
+var quitIn, quitOut filterList
+
+
+// HookPart adds the given filter to part reasons.
+// The filter receives the parting user, the channel, the recipient, and the
+// reason, and returns the modified reason, or an error. An error from an
+// input filter stops the reason from being used, and from an output filter,
+// hides it from that recipient; the user parts regardless.
+// If output is true, the filter is run for each user shown the part;
+// otherwise, once as the user parts, with a nil recipient.
+// May only be used during init.
+func HookPart(output bool, order int, f func(*core.User, *core.Channel, *core.User, []byte) ([]byte, os.Error)) {
+	pick(output, &partIn, &partOut).add(order, true, "", f)
+}
+
+// HookQuit adds the given filter to quit reasons.
+// The filter receives the quitting user, the recipient, and the reason, and
+// returns the modified reason, or an error. An error from an input filter
+// stops the reason from being used, and from an output filter, hides it from
+// that recipient; the user quits regardless.
+// If output is true, the filter is run for each user shown the quit;
+// otherwise, once as the user quits, with a nil recipient.
+// May only be used during init.
+func HookQuit(output bool, order int, f func(*core.User, *core.User, []byte) ([]byte, os.Error)) {
+	pick(output, &quitIn, &quitOut).add(order, true, "", f)
+}
+
+
+// Part runs the input filters on the given user's part reason for the given
+// channel. On error, the reason should be dropped.
+func Part(source *core.User, ch *core.Channel, reason []byte) ([]byte, os.Error) {
+	return runPart(partIn, source, ch, nil, reason)
+}
+
+// PartTo runs the output filters on the given user's part reason for the
+// given channel, as shown to the recipient. On error, the reason should be
+// hidden from them.
+func PartTo(source *core.User, ch *core.Channel, recipient *core.User, reason []byte) ([]byte, os.Error) {
+	return runPart(partOut, source, ch, recipient, reason)
+}
+
+func runPart(l filterList, source *core.User, ch *core.Channel, recipient *core.User, reason []byte) ([]byte, os.Error) {
+	return l.run("", reason, func(h interface{}, reason []byte) ([]byte, os.Error) {
+		f, ok := h.(func(*core.User, *core.Channel, *core.User, []byte) ([]byte, os.Error))
+		if ok && f != nil {
+			return f(source, ch, recipient, reason)
+		}
+		return reason, nil
+	})
+}
+
+
+// Quit runs the input filters on the given user's quit reason. On error, the
+// reason should be dropped.
+func Quit(source *core.User, reason []byte) ([]byte, os.Error) {
+	return runQuit(quitIn, source, nil, reason)
+}
+
+// QuitTo runs the output filters on the given user's quit reason, as shown to
+// the recipient. On error, the reason should be hidden from them.
+func QuitTo(source, recipient *core.User, reason []byte) ([]byte, os.Error) {
+	return runQuit(quitOut, source, recipient, reason)
+}
+
+func runQuit(l filterList, source, recipient *core.User, reason []byte) ([]byte, os.Error) {
+	return l.run("", reason, func(h interface{}, reason []byte) ([]byte, os.Error) {
+		f, ok := h.(func(*core.User, *core.User, []byte) ([]byte, os.Error))
+		if ok && f != nil {
+			return f(source, recipient, reason)
+		}
+		return reason, nil
+	})
+}
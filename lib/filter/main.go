@@ -0,0 +1,73 @@
+/*
+	Implements hookable filters, modifying messages before they are sent.
+
+	For each type of message, there are two lists of filters; input
+	filters, run once on a message as it is sent, and output filters, run
+	separately for each user it is delivered to.
+
+	Filters are run in order, lowest first, each receiving the message as
+	modified by those before it. A filter may instead return an error, which
+	stops the message from being sent, or for output filters, being seen by
+	that recipient. Filters added with the same order run in the order they
+	were added.
+
+	Suggested orders are as follows:
+
+	0-99: Normalisation, such as stripping colours.
+
+	100-199: Modification of content, such as censoring.
+
+	200+: Blocking, such as by pattern or sender.
+*/
+package filter
+
+import "os"
+
+
+// A filter in a list, with its order, and the type of message it applies to.
+type filter struct {
+	order int
+	all   bool
+	t     string
+	f     interface{}
+}
+
+// A list of filters, kept sorted by order.
+type filterList []filter
+
+// Adds a filter to the list, after any others with the same order.
+func (l *filterList) add(order int, all bool, t string, f interface{}) {
+	i := len(*l)
+	for i > 0 && (*l)[i-1].order > order {
+		i--
+	}
+
+	*l = append(*l, filter{})
+	copy((*l)[i+1:], (*l)[i:])
+	(*l)[i] = filter{order, all, t, f}
+}
+
+// Runs a filter list on a message of the given type, returning the filtered
+// message, or an error if a filter stopped it.
+func (l filterList) run(t string, message []byte, f func(interface{}, []byte) ([]byte, os.Error)) ([]byte, os.Error) {
+	for _, h := range l {
+		if !h.all && h.t != t {
+			continue
+		}
+
+		var err os.Error
+		if message, err = f(h.f, message); err != nil {
+			return nil, err
+		}
+	}
+
+	return message, nil
+}
+
+// Returns the list to use for input or output.
+func pick(output bool, in, out *filterList) *filterList {
+	if output {
+		return out
+	}
+	return in
+}
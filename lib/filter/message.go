@@ -0,0 +1,81 @@
+package filter
+
+import "os"
+
+import "oddcomm/src/core"
+
+
+var userMsgIn, userMsgOut filterList
+var chanMsgIn, chanMsgOut filterList
+
+
+// HookUserMsg adds the given filter to user messages.
+// The filter receives the source, the target, and the message, and returns
+// the modified message, or an error explaining why it may not be sent.
+// If output is true, the filter is run for each user the message is delivered
+// to; otherwise, once as it is sent.
+// If all is true, the filter is run for all types of message. Otherwise, t is
+// the type of message it wants to affect.
+// May only be used during init.
+func HookUserMsg(output bool, order int, all bool, t string, f func(*core.User, *core.User, []byte) ([]byte, os.Error)) {
+	pick(output, &userMsgIn, &userMsgOut).add(order, all, t, f)
+}
+
+// HookChanMsg adds the given filter to channel messages.
+// The filter receives the source, the channel, the recipient, and the
+// message, and returns the modified message, or an error explaining why it may
+// not be sent. If output is true, the filter is run for each member the
+// message is delivered to; otherwise, once as it is sent, with a nil
+// recipient.
+// If all is true, the filter is run for all types of message. Otherwise, t is
+// the type of message it wants to affect.
+// May only be used during init.
+func HookChanMsg(output bool, order int, all bool, t string, f func(*core.User, *core.Channel, *core.User, []byte) ([]byte, os.Error)) {
+	pick(output, &chanMsgIn, &chanMsgOut).add(order, all, t, f)
+}
+
+
+// UserMsg runs the input filters on the given message from the source to the
+// target, of the given message type.
+func UserMsg(source, target *core.User, message []byte, t string) ([]byte, os.Error) {
+	return runUserMsg(userMsgIn, source, target, message, t)
+}
+
+// UserMsgTo runs the output filters on the given message from the source to
+// the target, of the given message type.
+func UserMsgTo(source, target *core.User, message []byte, t string) ([]byte, os.Error) {
+	return runUserMsg(userMsgOut, source, target, message, t)
+}
+
+func runUserMsg(l filterList, source, target *core.User, message []byte, t string) ([]byte, os.Error) {
+	return l.run(t, message, func(h interface{}, message []byte) ([]byte, os.Error) {
+		f, ok := h.(func(*core.User, *core.User, []byte) ([]byte, os.Error))
+		if ok && f != nil {
+			return f(source, target, message)
+		}
+		return message, nil
+	})
+}
+
+
+// ChanMsg runs the input filters on the given message from the source to the
+// channel, of the given message type.
+func ChanMsg(source *core.User, ch *core.Channel, message []byte, t string) ([]byte, os.Error) {
+	return runChanMsg(chanMsgIn, source, ch, nil, message, t)
+}
+
+// ChanMsgTo runs the output filters on the given message from the source to
+// the channel, as delivered to the given member, of the given message type.
+func ChanMsgTo(source *core.User, ch *core.Channel, recipient *core.User, message []byte, t string) ([]byte, os.Error) {
+	return runChanMsg(chanMsgOut, source, ch, recipient, message, t)
+}
+
+func runChanMsg(l filterList, source *core.User, ch *core.Channel, recipient *core.User, message []byte, t string) ([]byte, os.Error) {
+	return l.run(t, message, func(h interface{}, message []byte) ([]byte, os.Error) {
+		f, ok := h.(func(*core.User, *core.Channel, *core.User, []byte) ([]byte, os.Error))
+		if ok && f != nil {
+			return f(source, ch, recipient, message)
+		}
+		return message, nil
+	})
+}
@@ -31,6 +31,11 @@ type Command struct {
 	// Either "" for non-oper commands, or the command's corresponding flag
 	// for an oper command.
 	OperFlag string
+
+	// The command's cost for flood control, in milliseconds of penalty.
+	// Zero for the default cost of the package using the dispatcher, and
+	// negative for commands which are free.
+	Cost int64
 }
 
 
@@ -7,17 +7,28 @@ import "io"
 // given function with each line. When an error occurs, it returns an error message
 // explaining it.
 func ReadLine(r io.Reader, b []byte, f func(line []byte)) (errMsg string) {
+	return ReadLineLimit(r, b, func() int { return cap(b) }, f)
+}
+
+// ReadLineLimit reads lines as ReadLine does, reading ahead no more than the
+// number of bytes limit returns, which is checked before each read and may
+// change between lines. Limits beyond the buffer's capacity are cut to it.
+func ReadLineLimit(r io.Reader, b []byte, limit func() int, f func(line []byte)) (errMsg string) {
 	var count int
 	for {
 		// If we have no room in our input buffer to read, the user
 		// has overrun their input buffer.
-		if count == cap(b) {
+		max := limit()
+		if max > cap(b) {
+			max = cap(b)
+		}
+		if count >= max {
 			errMsg = "Input Buffer Exceeded"
 			break
 		}
 
 		// Try to read from the user.
-		n, err := r.Read(b[count:cap(b)])
+		n, err := r.Read(b[count:max])
 		if err != nil {
 			// This happens if the user is disconnected
 			// by other code. In this case, the error message
@@ -92,7 +103,40 @@ func ReadLine(r io.Reader, b []byte, f func(line []byte)) (errMsg string) {
 	return
 }
 
+// Parse parses a line, looking up its command in the given dispatcher. Any
+// message tags are checked against MaxTagData, then ignored; use ParseTagged
+// to get them.
 func Parse(d CommandDispatcher, line []byte, regged bool) (origin []byte, command *Command, params [][]byte, err *ParseError) {
+	_, origin, command, params, err = ParseTagged(d, line, regged)
+	return
+}
+
+// ParseTagged parses a line as Parse, also returning its message tags, or nil
+// if it has none.
+func ParseTagged(d CommandDispatcher, line []byte, regged bool) (tags Tags, origin []byte, command *Command, params [][]byte, err *ParseError) {
+	return ParseTaggedLimit(d, line, regged, MaxTagData)
+}
+
+// ParseTaggedLimit parses a line as ParseTagged, with the given limit on its
+// tag data, such as MaxClientTagData for lines from clients.
+func ParseTaggedLimit(d CommandDispatcher, line []byte, regged bool, maxTags int) (tags Tags, origin []byte, command *Command, params [][]byte, err *ParseError) {
+
+	// Split off and parse any tags. They're limited separately from the
+	// rest of the line.
+	raw, line := SplitTags(line)
+	if len(raw) > maxTags {
+		err = newParseError(TagsTooLong, "")
+		return
+	}
+	if raw != nil {
+		tags = ParseTags(raw)
+	}
+
+	origin, command, params, err = parse(d, line, regged)
+	return
+}
+
+func parse(d CommandDispatcher, line []byte, regged bool) (origin []byte, command *Command, params [][]byte, err *ParseError) {
 
 	// We can handle up to 50 parameters. This is plenty.
 	var param_array [50][]byte
@@ -209,6 +253,7 @@ const (
 	CmdForRegistered
 	CmdForUnregistered
 	CmdTooFewParams
+	TagsTooLong
 )
 
 // String returns an error message for the parse error.
@@ -223,6 +268,8 @@ func (err *ParseError) String() string {
 		return "You may not reregister."
 	case CmdTooFewParams:
 		return "Not enough parameters."
+	case TagsTooLong:
+		return "Input line was too long."
 	}
 
 	// We don't really know what happened, so bullshit them.
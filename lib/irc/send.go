@@ -5,23 +5,45 @@ import "io"
 
 // SendLine sends a formatted line from the given source, to the given target.
 func SendLine(w io.Writer, source, target, cmd, format string, args ...interface{}) {
-	newargs := make([]interface{}, len(args)+3)
-	newargs[0] = source
-	newargs[1] = cmd
-	newargs[2] = target
-	copy(newargs[3:], args)
+	SendLineTags(w, nil, source, target, cmd, format, args...)
+}
+
+// SendLineTags sends a formatted line from the given source, to the given
+// target, prefixed by the given message tags if there are any. Tags do not
+// count toward the line's 512 byte limit.
+func SendLineTags(w io.Writer, tags Tags, source, target, cmd, format string, args ...interface{}) {
+	newargs := make([]interface{}, len(args)+4)
+	newargs[0] = tagPrefix(tags)
+	newargs[1] = source
+	newargs[2] = cmd
+	newargs[3] = target
+	copy(newargs[4:], args)
 
-	fmt.Fprintf(w, ":%s %s %s " + format + "\r\n", newargs...)
+	fmt.Fprintf(w, "%s:%s %s %s " + format + "\r\n", newargs...)
 }
 
 // SendFrom sends a given prewritten line, prefixd by the given source.
 // source may be a nil interface or a nil value, in which case the line will
 func SendFrom(w io.Writer, source, format string, args ...interface{}) {
-	newargs := make([]interface{}, len(args)+1)
-	newargs[0] = source
-	copy(newargs[1:], args)
-
-	fmt.Fprintf(w, ":%s " + format + "\r\n", newargs...)
+	SendFromTags(w, nil, source, format, args...)
 }
 
+// SendFromTags sends a given prewritten line, prefixed by the given message
+// tags if there are any, and the given source.
+func SendFromTags(w io.Writer, tags Tags, source, format string, args ...interface{}) {
+	newargs := make([]interface{}, len(args)+2)
+	newargs[0] = tagPrefix(tags)
+	newargs[1] = source
+	copy(newargs[2:], args)
 
+	fmt.Fprintf(w, "%s:%s " + format + "\r\n", newargs...)
+}
+
+// Returns the tag section for the start of a line with the given tags, or ""
+// if there are none.
+func tagPrefix(tags Tags) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	return "@" + tags.String() + " "
+}
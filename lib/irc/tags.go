@@ -0,0 +1,148 @@
+package irc
+
+import "bytes"
+import "fmt"
+import "sort"
+import "strings"
+import "time"
+
+// The most bytes of tag data a line may carry, excluding the leading '@' and
+// the space following the tags. Tag data does not count toward the 512 byte
+// limit on the rest of the line.
+const MaxTagData = 8189
+
+// The most bytes of tag data a client may send.
+const MaxClientTagData = 4094
+
+// Represents a set of IRCv3 message tags, mapping tag names, including any
+// vendor prefix or leading '+', to unescaped values. A tag with no value has
+// an empty value.
+type Tags map[string]string
+
+
+// SplitTags splits the tag data from the start of a line, if it has any,
+// returning it without its leading '@', and the rest of the line. If the line
+// has no tags, tags is nil.
+func SplitTags(line []byte) (tags, rest []byte) {
+	if len(line) == 0 || line[0] != '@' {
+		return nil, line
+	}
+
+	space := bytes.IndexByte(line, ' ')
+	if space == -1 {
+		return line[1:], line[len(line):]
+	}
+
+	tags = line[1:space]
+	for space < len(line)-1 && line[space+1] == ' ' {
+		space++
+	}
+	rest = line[space+1:]
+
+	return
+}
+
+// ParseTags parses tag data, without its leading '@', into a set of tags.
+// Where a tag appears more than once, the last value is used.
+func ParseTags(raw []byte) Tags {
+	tags := make(Tags)
+
+	for _, tag := range strings.Split(string(raw), ";", -1) {
+		var name, value string
+		if eq := strings.Index(tag, "="); eq != -1 {
+			name, value = tag[:eq], UnescapeTag(tag[eq+1:])
+		} else {
+			name = tag
+		}
+
+		if name != "" {
+			tags[name] = value
+		}
+	}
+
+	return tags
+}
+
+// String returns the set of tags as tag data, without a leading '@', with
+// values escaped. Tags are sorted by name.
+func (tags Tags) String() string {
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for i, name := range names {
+		if i != 0 {
+			buf.WriteByte(';')
+		}
+		buf.WriteString(name)
+		if value := tags[name]; value != "" {
+			buf.WriteByte('=')
+			buf.WriteString(EscapeTag(value))
+		}
+	}
+
+	return buf.String()
+}
+
+// EscapeTag escapes a tag value for sending.
+func EscapeTag(value string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case ';':
+			buf.WriteString("\\:")
+		case ' ':
+			buf.WriteString("\\s")
+		case '\\':
+			buf.WriteString("\\\\")
+		case '\r':
+			buf.WriteString("\\r")
+		case '\n':
+			buf.WriteString("\\n")
+		default:
+			buf.WriteByte(value[i])
+		}
+	}
+	return buf.String()
+}
+
+// UnescapeTag unescapes a received tag value. Unknown escapes are replaced by
+// the escaped character, and a trailing lone backslash is dropped.
+func UnescapeTag(value string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			buf.WriteByte(value[i])
+			continue
+		}
+
+		i++
+		if i == len(value) {
+			break
+		}
+
+		switch value[i] {
+		case ':':
+			buf.WriteByte(';')
+		case 's':
+			buf.WriteByte(' ')
+		case 'r':
+			buf.WriteByte('\r')
+		case 'n':
+			buf.WriteByte('\n')
+		default:
+			buf.WriteByte(value[i])
+		}
+	}
+	return buf.String()
+}
+
+// ServerTime returns the given time, in nanoseconds since the epoch, in the
+// format used for the value of the server-time "time" tag.
+func ServerTime(ns int64) string {
+	t := time.SecondsToUTC(ns / 1e9)
+	return t.Format("2006-01-02T15:04:05") + fmt.Sprintf(".%03dZ", ns/1e6%1000)
+}
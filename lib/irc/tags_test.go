@@ -0,0 +1,119 @@
+package irc
+
+import "testing"
+
+
+// Returns whether two sets of tags are the same.
+func sameTags(a, b Tags) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		if other, ok := b[name]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSplitTags(t *testing.T) {
+	tests := []struct {
+		line       string
+		tagged     bool
+		tags, rest string
+	}{
+		{"PING :x", false, "", "PING :x"},
+		{"", false, "", ""},
+		{"@a=b;c :nick PRIVMSG #chan :hi", true, "a=b;c", ":nick PRIVMSG #chan :hi"},
+		{"@a=b   PING", true, "a=b", "PING"},
+		{"@a=b", true, "a=b", ""},
+		{"@ PING", true, "", "PING"},
+		{"@", true, "", ""},
+	}
+
+	for _, test := range tests {
+		tags, rest := SplitTags([]byte(test.line))
+		if (tags != nil) != test.tagged || string(tags) != test.tags || string(rest) != test.rest {
+			t.Errorf("SplitTags(%q) = %q (tagged %v), %q; want %q (tagged %v), %q", test.line, tags, tags != nil, rest, test.tags, test.tagged, test.rest)
+		}
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		raw  string
+		tags Tags
+	}{
+		{"", Tags{}},
+		{"a=b;c=d", Tags{"a": "b", "c": "d"}},
+		{"+example.com/x=y", Tags{"+example.com/x": "y"}},
+		{"a", Tags{"a": ""}},
+		{"a=", Tags{"a": ""}},
+		{"a=1;a=2", Tags{"a": "2"}},
+		{"a=1;a", Tags{"a": ""}},
+		{";;a=1;", Tags{"a": "1"}},
+		{"=x;a=1", Tags{"a": "1"}},
+		{`a=\:\s\\\r\n`, Tags{"a": "; \\\r\n"}},
+		{`a=x\`, Tags{"a": "x"}},
+		{`a=b=c`, Tags{"a": "b=c"}},
+	}
+
+	for _, test := range tests {
+		if tags := ParseTags([]byte(test.raw)); !sameTags(tags, test.tags) {
+			t.Errorf("ParseTags(%q) = %v, want %v", test.raw, tags, test.tags)
+		}
+	}
+}
+
+func TestEscapeTag(t *testing.T) {
+	tests := []struct {
+		value, escaped string
+	}{
+		{"", ""},
+		{"plain", "plain"},
+		{";", `\:`},
+		{" ", `\s`},
+		{"\\", `\\`},
+		{"\r", `\r`},
+		{"\n", `\n`},
+		{"a; b\\c\r\nd", `a\:\sb\\c\r\nd`},
+		{"\\s", `\\s`},
+	}
+
+	for _, test := range tests {
+		if escaped := EscapeTag(test.value); escaped != test.escaped {
+			t.Errorf("EscapeTag(%q) = %q, want %q", test.value, escaped, test.escaped)
+		}
+		if value := UnescapeTag(test.escaped); value != test.value {
+			t.Errorf("UnescapeTag(%q) = %q, want %q", test.escaped, value, test.value)
+		}
+	}
+}
+
+func TestUnescapeTag(t *testing.T) {
+	tests := []struct {
+		escaped, value string
+	}{
+		{`\`, ""},
+		{`abc\`, "abc"},
+		{`\\\`, "\\"},
+		{`\x`, "x"},
+		{`\b\a\:`, "ba;"},
+	}
+
+	for _, test := range tests {
+		if value := UnescapeTag(test.escaped); value != test.value {
+			t.Errorf("UnescapeTag(%q) = %q, want %q", test.escaped, value, test.value)
+		}
+	}
+}
+
+func TestTagsString(t *testing.T) {
+	tags := Tags{"b": "x y", "a": "", "+c": "1;2"}
+	if s := tags.String(); s != `+c=1\:2;a;b=x\sy` {
+		t.Errorf("String() = %q, want %q", s, `+c=1\:2;a;b=x\sy`)
+	}
+	if parsed := ParseTags([]byte(tags.String())); !sameTags(parsed, tags) {
+		t.Errorf("ParseTags(String()) = %v, want %v", parsed, tags)
+	}
+}
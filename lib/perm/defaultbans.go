@@ -11,8 +11,26 @@ func init() {
 		}
 		return false
 	})
+	AddBanType("certfp", func(u *core.User, mask string) bool {
+		if fp := u.Data("certfp"); fp != "" {
+			return GMatch(fp, mask)
+		}
+		return false
+	})
 	AddBanType("host", func(u *core.User, mask string) bool {
-		nuh := u.Nick() + "!" + u.GetIdent() + "@" + u.GetHostname()
-		return GMatch(nuh, mask)
+		// Match hidden hosts too, so bans on what others see work.
+		nu := u.Nick() + "!" + u.GetIdent() + "@"
+		for _, host := range []string{u.GetHostname(), u.Data("cloak"), u.Data("vhost")} {
+			if host != "" && GMatch(nu+host, mask) {
+				return true
+			}
+		}
+		return false
+	})
+	AddBanType("webirc", func(u *core.User, mask string) bool {
+		if gateway := u.Data("webirc"); gateway != "" {
+			return GMatch(gateway, mask)
+		}
+		return false
 	})
 }
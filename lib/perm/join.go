@@ -7,6 +7,7 @@ import "oddcomm/src/core"
 
 var checkJoin = make(map[string][]interface{})
 var checkRemove = make(map[string][]interface{})
+var checkDelete = make(map[string][]interface{})
 
 
 func init() {
@@ -18,6 +19,15 @@ func init() {
 	HookRemove("", selfOverride)
 	HookRemove("", opKickImmune)
 	HookRemove("", opKickOverride)
+
+	// Delete channels when their last member leaves, if permitted.
+	// Only the node the removal came from decides; remote removals have
+	// a server, not a package name, as their origin.
+	core.HookChanUserRemove("", func(origin interface{}, source, _ *core.User, ch *core.Channel, _ string) {
+		if pkg, ok := origin.(string); ok {
+			DeleteEmpty(pkg, source, ch)
+		}
+	})
 }
 
 
@@ -39,6 +49,17 @@ func HookRemove(chantype string, f func(string, *core.User, *core.User, *core.Ch
 	checkRemove[chantype] = append(checkRemove[chantype], f)
 }
 
+// HookDelete adds the given hook to CheckDelete checks.
+// The hook receives the source, if any, of the removal or creation which left
+// the channel empty, and the channel.
+// It should return a number indicating granted or denied permission, and the
+// level of it. If the number is negative, the channel is kept, and err
+// should be non-nil and indicate why. See package comment for permission
+// levels.
+func HookDelete(chantype string, f func(string, *core.User, *core.Channel) (int, os.Error)) {
+	checkDelete[chantype] = append(checkDelete[chantype], f)
+}
+
 
 // CheckJoin tests whether the given user can join the given channel.
 func CheckJoin(pkg string, source *core.User, target *core.Channel) (bool, os.Error) {
@@ -78,3 +99,40 @@ func CheckRemovePerm(pkg string, source, target *core.User, ch *core.Channel) (i
 
 	return runPermHooks(checkRemove[ch.Type()], f, false)
 }
+
+// CheckDelete tests whether the given empty channel may be deleted.
+func CheckDelete(pkg string, source *core.User, ch *core.Channel) (bool, os.Error) {
+	perm, err := CheckDeletePerm(pkg, source, ch)
+	return perm > 0, err
+}
+
+// CheckDeletePerm returns the full permissions value for CheckDelete.
+func CheckDeletePerm(pkg string, source *core.User, ch *core.Channel) (int, os.Error) {
+	f := func(h interface{}) (int, os.Error) {
+		f, ok := h.(func(string, *core.User, *core.Channel) (int, os.Error))
+		if ok && f != nil {
+			return f(pkg, source, ch)
+		}
+		return 0, nil
+	}
+
+	return runPermHooks(checkDelete[ch.Type()], f, true)
+}
+
+// DeleteEmpty deletes the given channel if it has no members and CheckDelete
+// permits it, returning whether it was deleted. It is called whenever a user
+// leaves a channel on this server, and should be called by anything creating
+// channels which may be left empty, such as if every join was refused.
+//
+// The channel is marked transient, which the core deletes it for having no
+// members attached.
+func DeleteEmpty(pkg string, source *core.User, ch *core.Channel) bool {
+	if ch.Users() != nil {
+		return false
+	}
+	if ok, _ := CheckDelete(pkg, source, ch); !ok {
+		return false
+	}
+	ch.SetData(pkg, source, "transient", "on")
+	return true
+}
@@ -92,9 +92,9 @@ func CheckChanMsg(source *core.User, target *core.Channel, message []byte, t str
 // CheckChanMsgPerm returns the full permissions value for CheckChanMsg.
 func CheckChanMsgPerm(source *core.User, target *core.Channel, message []byte, t string) (int, os.Error) {
 	f := func(f interface{}) (int, os.Error) {
-		h, ok := f.(func(*core.User, *core.Channel, []byte) (int, os.Error))
+		h, ok := f.(func(string, *core.User, *core.Channel, []byte) (int, os.Error))
 		if ok && h != nil {
-			return h(source, target, message)
+			return h("", source, target, message)
 		}
 		return 0, nil
 	}
@@ -0,0 +1,7 @@
+package flood
+
+import "oddcomm/src/client"
+
+func init() {
+	client.ChanModes.AddParametered('f', "restrict flood")
+}
@@ -0,0 +1,261 @@
+/*
+	Implements the "flood" channel restriction, limiting how many lines
+	may be sent to a channel in a period of time, by each user or by
+	everyone together, and muting, kicking, or temporarily moderating
+	when the limit is exceeded.
+
+	Only lines from members are counted; users exempted from the
+	restriction, voiced users, and chanops with the "msg" flag are not.
+*/
+package flood
+
+import "os"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+import "oddcomm/src/core"
+import "oddcomm/lib/perm"
+
+
+var me string = "modules/chan/flood"
+
+// A channel's flood limit, as set in its "restrict flood" metadata, in the
+// form "<lines>:<seconds>[:<scope>[:<action>]]".
+type Limit struct {
+	Lines   int
+	Seconds int64
+	Scope   string // "user" or "channel"; who the lines are counted for.
+	Action  string // "mute", "kick", or "moderate".
+}
+
+// Lines counted in the current period.
+type counter struct {
+	start int64
+	lines int
+}
+
+// A channel's flood state.
+type state struct {
+	channel counter
+	users   map[*core.User]*counter
+	muted   map[*core.User]int64 // When users' mutes expire.
+}
+
+// Maps channels to their flood state.
+var states = make(map[*core.Channel]*state)
+
+// Maps channels we've moderated to the mode's expiry, for as long as we're
+// the ones who set it. If anyone else changes it, it's theirs.
+var moderated = make(map[*core.Channel]int64)
+
+var mutex sync.Mutex
+
+
+func init() {
+	perm.HookChanMsg(true, "", "", checkFlood)
+
+	// Count lines once they've actually been sent.
+	core.HookChanMessage("", "", countFlood)
+	core.HookChanMessage("", "noreply", countFlood)
+
+	// Only valid limits may be set.
+	perm.HookCheckChanData("", "restrict flood", func(_ string, _ *core.User, _ *core.Channel, _, value string) (int, os.Error) {
+		if value == "" {
+			return 0, nil
+		}
+		if _, err := ParseLimit(value); err != nil {
+			return -1e9, err
+		}
+		return 0, nil
+	})
+
+	// Forget users who leave, and channels when the limit is removed or
+	// they're emptied, as they are before being deleted.
+	core.HookChanUserRemove("", func(_ interface{}, _, u *core.User, ch *core.Channel, _ string) {
+		mutex.Lock()
+		if ch.Users() == nil {
+			states[ch] = nil, false
+		} else if s := states[ch]; s != nil {
+			s.users[u] = nil, false
+			s.muted[u] = 0, false
+		}
+		mutex.Unlock()
+	})
+	core.HookChanDataChange("", "restrict flood", func(_ interface{}, _ *core.User, ch *core.Channel, _, _ string) {
+		mutex.Lock()
+		states[ch] = nil, false
+		mutex.Unlock()
+	})
+
+	// If anyone else changes moderation we set, leave it to them.
+	core.HookChanDataChange("", "restrict mute", func(origin interface{}, _ *core.User, ch *core.Channel, _, _ string) {
+		if pkg, ok := origin.(string); ok && pkg == me {
+			return
+		}
+		mutex.Lock()
+		moderated[ch] = 0, false
+		mutex.Unlock()
+	})
+}
+
+
+// ParseLimit parses a flood limit, filling in the default scope of "user"
+// and action of "mute" if omitted.
+func ParseLimit(value string) (*Limit, os.Error) {
+	fields := strings.Split(value, ":", -1)
+	if len(fields) < 2 || len(fields) > 4 {
+		return nil, os.NewError("Flood limits must be <lines>:<seconds>[:<user|channel>[:<mute|kick|moderate>]].")
+	}
+
+	l := new(Limit)
+	l.Scope = "user"
+	l.Action = "mute"
+
+	var err os.Error
+	if l.Lines, err = strconv.Atoi(fields[0]); err != nil || l.Lines < 1 {
+		return nil, os.NewError("Flood limit lines must be a positive number.")
+	}
+	if l.Seconds, err = strconv.Atoi64(fields[1]); err != nil || l.Seconds < 1 {
+		return nil, os.NewError("Flood limit seconds must be a positive number.")
+	}
+	if len(fields) > 2 {
+		l.Scope = strings.ToLower(fields[2])
+		if l.Scope != "user" && l.Scope != "channel" {
+			return nil, os.NewError("Flood limit scope must be user or channel.")
+		}
+	}
+	if len(fields) > 3 {
+		l.Action = strings.ToLower(fields[3])
+		if l.Action != "mute" && l.Action != "kick" && l.Action != "moderate" {
+			return nil, os.NewError("Flood limit action must be mute, kick, or moderate.")
+		}
+	}
+
+	return l, nil
+}
+
+
+// Returns the flood limit applying to the given user on the given channel,
+// or nil if they're exempt or it has none. Only members are counted.
+func limitFor(source *core.User, ch *core.Channel) *Limit {
+	if !perm.Restricted(source, ch, "flood") || perm.HasOpFlag(source, ch, "msg") {
+		return nil
+	}
+	m := ch.GetMember(source)
+	if m == nil || m.Data("voiced") != "" {
+		return nil
+	}
+	l, err := ParseLimit(ch.Data("restrict flood"))
+	if err != nil {
+		return nil
+	}
+	return l
+}
+
+// Denies messages to a channel with a flood limit from users muted for
+// flooding it. Lines are only counted once sent, by countFlood, so lines
+// other hooks refuse are not counted.
+func checkFlood(_ string, source *core.User, ch *core.Channel, msg []byte) (int, os.Error) {
+	if limitFor(source, ch) == nil {
+		return 0, nil
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if s := states[ch]; s != nil && s.muted[source] > time.Seconds() {
+		return -100, os.NewError("You are muted for flooding the channel.")
+	}
+	return 0, nil
+}
+
+// Counts a line sent to a channel with a flood limit, and acts if it reaches
+// the limit. Every server counts, but only the one the line came from acts.
+func countFlood(origin interface{}, source *core.User, ch *core.Channel, _ []byte) {
+	l := limitFor(source, ch)
+	if l == nil {
+		return
+	}
+
+	now := time.Seconds()
+	mutex.Lock()
+	s := states[ch]
+	if s == nil {
+		s = new(state)
+		s.users = make(map[*core.User]*counter)
+		s.muted = make(map[*core.User]int64)
+		states[ch] = s
+	}
+	if expiry, ok := s.muted[source]; ok && expiry <= now {
+		s.muted[source] = 0, false
+	}
+
+	c := &s.channel
+	if l.Scope == "user" {
+		if c = s.users[source]; c == nil {
+			c = new(counter)
+			s.users[source] = c
+		}
+	}
+	if now-c.start >= l.Seconds {
+		c.start = now
+		c.lines = 0
+	}
+	c.lines++
+	if c.lines < l.Lines {
+		mutex.Unlock()
+		return
+	}
+	c.start = now
+	c.lines = 0
+
+	if l.Action == "mute" {
+		s.muted[source] = now + l.Seconds
+	}
+	mutex.Unlock()
+
+	if _, local := origin.(string); !local {
+		return
+	}
+
+	switch l.Action {
+	case "kick":
+		go ch.Remove(me, nil, source, "Channel flood ("+strconv.Itoa(l.Lines)+" lines in "+strconv.Itoa64(l.Seconds)+" seconds)")
+	case "moderate":
+		go moderate(ch, l.Seconds)
+	}
+}
+
+// Restricts speaking on a channel for the given number of seconds, unless
+// someone else already has. If we already have, extends it.
+func moderate(ch *core.Channel, seconds int64) {
+	expiry := time.Seconds() + seconds
+
+	mutex.Lock()
+	_, ours := moderated[ch]
+	if !ours && ch.Data("restrict mute") != "" {
+		mutex.Unlock()
+		return
+	}
+	moderated[ch] = expiry
+	mutex.Unlock()
+
+	if !ours {
+		ch.SetData(me, nil, "restrict mute", "on")
+	}
+	time.Sleep(seconds * 1e9)
+
+	// Only lift it if it's still ours, and not since extended.
+	mutex.Lock()
+	lift := moderated[ch] == expiry
+	if lift {
+		moderated[ch] = 0, false
+	}
+	mutex.Unlock()
+
+	if lift {
+		ch.SetData(me, nil, "restrict mute", "")
+	}
+}
@@ -0,0 +1,7 @@
+package jointhrottle
+
+import "oddcomm/src/client"
+
+func init() {
+	client.ChanModes.AddParametered('j', "restrict jointhrottle")
+}
@@ -0,0 +1,137 @@
+/*
+	Implements the "jointhrottle" channel restriction, limiting how many
+	users may join a channel in a period of time, to defend against join
+	floods.
+
+	Users exempted from the restriction, and opers holding op flags, may join
+	regardless, and are not counted.
+*/
+package jointhrottle
+
+import "os"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+import "oddcomm/src/core"
+import "oddcomm/lib/perm"
+
+
+// Joins counted in a channel's current period.
+type counter struct {
+	start int64
+	joins int
+}
+
+// Maps channels to their joins this period.
+var counters = make(map[*core.Channel]*counter)
+var mutex sync.Mutex
+
+
+func init() {
+	perm.HookJoin("", checkThrottle)
+	core.HookChanUserJoin("", countJoins)
+
+	// Only valid limits may be set.
+	perm.HookCheckChanData("", "restrict jointhrottle", func(_ string, _ *core.User, _ *core.Channel, _, value string) (int, os.Error) {
+		if value == "" {
+			return 0, nil
+		}
+		if _, _, err := ParseLimit(value); err != nil {
+			return -1e9, err
+		}
+		return 0, nil
+	})
+
+	// Start counting afresh when the limit changes.
+	core.HookChanDataChange("", "restrict jointhrottle", func(_ interface{}, _ *core.User, ch *core.Channel, _, _ string) {
+		mutex.Lock()
+		counters[ch] = nil, false
+		mutex.Unlock()
+	})
+
+	// Forget channels once they're emptied, as they are before being
+	// deleted.
+	core.HookChanUserRemove("", func(_ interface{}, _, _ *core.User, ch *core.Channel, _ string) {
+		if ch.Users() != nil {
+			return
+		}
+		mutex.Lock()
+		counters[ch] = nil, false
+		mutex.Unlock()
+	})
+}
+
+
+// ParseLimit parses a join throttle limit, in the form "<joins>:<seconds>".
+func ParseLimit(value string) (joins int, seconds int64, err os.Error) {
+	fields := strings.Split(value, ":", -1)
+	if len(fields) != 2 {
+		return 0, 0, os.NewError("Join throttle limits must be <joins>:<seconds>.")
+	}
+	if joins, err = strconv.Atoi(fields[0]); err != nil || joins < 1 {
+		return 0, 0, os.NewError("Join throttle joins must be a positive number.")
+	}
+	if seconds, err = strconv.Atoi64(fields[1]); err != nil || seconds < 1 {
+		return 0, 0, os.NewError("Join throttle seconds must be a positive number.")
+	}
+	return
+}
+
+
+// Returns whether the given user's joins to the given channel are throttled,
+// and if so, the limit.
+func throttled(u *core.User, ch *core.Channel) (joins int, seconds int64, ok bool) {
+	if !perm.Restricted(u, ch, "jointhrottle") || u.Data("op") != "" {
+		return
+	}
+	joins, seconds, err := ParseLimit(ch.Data("restrict jointhrottle"))
+	return joins, seconds, err == nil
+}
+
+// Denies a join to a throttled channel if it has had too many joins this
+// period. Joins are counted once they happen, by countJoins, so joins
+// refused for any reason are not.
+func checkThrottle(_ string, source *core.User, ch *core.Channel) (int, os.Error) {
+	if ch.GetMember(source) != nil {
+		return 0, nil
+	}
+	joins, seconds, ok := throttled(source, ch)
+	if !ok {
+		return 0, nil
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	c := counters[ch]
+	if c == nil || time.Seconds()-c.start >= seconds || c.joins < joins {
+		return 0, nil
+	}
+	return -100, os.NewError("Channel is throttling joins (" + strconv.Itoa(joins) + " per " + strconv.Itoa64(seconds) + " seconds). Try again later.")
+}
+
+// Counts users joining a throttled channel.
+func countJoins(_ interface{}, ch *core.Channel, users []*core.User) {
+	now := time.Seconds()
+	for _, u := range users {
+		_, seconds, ok := throttled(u, ch)
+		if !ok {
+			continue
+		}
+
+		mutex.Lock()
+		c := counters[ch]
+		if c == nil {
+			c = new(counter)
+			counters[ch] = c
+		}
+		if now-c.start >= seconds {
+			c.start = now
+			c.joins = 0
+		}
+		c.joins++
+		mutex.Unlock()
+	}
+}
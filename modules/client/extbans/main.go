@@ -31,6 +31,8 @@ func init() {
 	// Add the built-in ban types.
 	ExtBanType.Add('H', "host")
 	ExtBanType.Add('A', "account")
+	ExtBanType.Add('Z', "certfp")
+	ExtBanType.Add('W', "webirc")
 
 	// Add the built-in ban restrictions.
 	ExtBanRestrict.Add('j', "join")
@@ -0,0 +1,99 @@
+package login
+
+import "os"
+import "strings"
+
+import "oddcomm/src/client"
+import "oddcomm/src/core"
+import "oddcomm/lib/irc"
+import "oddcomm/lib/perm"
+
+
+// Client certificate fingerprints are stored in global data, as
+// "certfp <fingerprint>", set to the account they log into.
+
+func init() {
+	// Log users in by their certificate's fingerprint.
+	perm.HookCheckLogin(func(_ string, u *core.User, account, authtype, auth string) (int, os.Error) {
+		if authtype != "certfp" || auth == "" {
+			return 0, nil
+		}
+		owner := core.Global.Data("certfp " + strings.ToLower(auth))
+		if owner == "" {
+			return 0, nil
+		}
+		if account != "" && strings.ToUpper(account) != strings.ToUpper(owner) {
+			return 0, nil
+		}
+		return 100, os.NewError(owner)
+	})
+
+	// Add certfp command.
+	c := new(irc.Command)
+	c.Name = "CERTFP"
+	c.Handler = cmdCertfp
+	c.Minargs = 0
+	c.Maxargs = 2
+	client.Commands.Add(c)
+}
+
+
+// CERTFP [LIST]
+// CERTFP ADD [<fingerprint>]
+// CERTFP DEL [<fingerprint>]
+//
+// Manages the certificate fingerprints which log into the user's account.
+// The fingerprint defaults to that of the certificate they connected with.
+func cmdCertfp(source interface{}, params [][]byte) {
+	c := source.(*client.Client)
+	u := c.User()
+
+	account := u.Data("account")
+	if account == "" {
+		c.SendFrom(nil, "NOTICE %s :*** You must be logged in to manage certificate fingerprints.", u.Nick())
+		return
+	}
+
+	subcommand := "LIST"
+	if len(params) > 0 {
+		subcommand = strings.ToUpper(string(params[0]))
+	}
+	fp := strings.ToLower(u.Data("certfp"))
+	if len(params) > 1 {
+		fp = strings.ToLower(string(params[1]))
+	}
+
+	switch subcommand {
+	case "LIST":
+		core.Global.DataRange("certfp ", func(name, value string) {
+			if strings.ToUpper(value) == strings.ToUpper(account) {
+				c.SendFrom(nil, "NOTICE %s :*** Certificate fingerprint: %s", u.Nick(), name[len("certfp "):])
+			}
+		})
+		c.SendFrom(nil, "NOTICE %s :*** End of certificate fingerprints.", u.Nick())
+
+	case "ADD":
+		if fp == "" || strings.IndexAny(fp, " :") != -1 {
+			c.SendFrom(nil, "NOTICE %s :*** No certificate fingerprint given.", u.Nick())
+			return
+		}
+		if owner := core.Global.Data("certfp " + fp); owner != "" {
+			c.SendFrom(nil, "NOTICE %s :*** Certificate fingerprint %s is already in use.", u.Nick(), fp)
+			return
+		}
+		core.Global.SetData("", u, "certfp "+fp, account)
+		c.SendFrom(nil, "NOTICE %s :*** Certificate fingerprint %s added.", u.Nick(), fp)
+
+	case "DEL":
+		owner := core.Global.Data("certfp " + fp)
+		if fp == "" || strings.ToUpper(owner) != strings.ToUpper(account) {
+			c.SendFrom(nil, "NOTICE %s :*** No such certificate fingerprint: %s", u.Nick(), fp)
+			return
+		}
+		core.Global.SetData("", u, "certfp "+fp, "")
+		c.SendFrom(nil, "NOTICE %s :*** Certificate fingerprint %s removed.", u.Nick(), fp)
+
+	default:
+		c.SendFrom(nil, "NOTICE %s :*** Unknown CERTFP subcommand: %s", u.Nick(), subcommand)
+	}
+}
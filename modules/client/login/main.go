@@ -1,5 +1,6 @@
 /*
-	Provides a command for password-based authentication to an account.
+	Provides commands for authentication to an account, by password, by
+	SASL, or by client certificate fingerprints added to the account.
 */
 package login
 
@@ -0,0 +1,189 @@
+package login
+
+import "encoding/base64"
+import "strings"
+import "sync"
+
+import "oddcomm/src/client"
+import "oddcomm/src/core"
+import "oddcomm/lib/irc"
+import "oddcomm/lib/perm"
+
+
+// The most bytes of base64 data an AUTHENTICATE line may carry. Longer
+// responses are split into lines of exactly this length, followed by a line
+// of less, or "+" if there is no remainder.
+const saslChunk = 400
+
+// The most bytes of base64 data a response may have in total.
+const saslMax = 8192
+
+
+// An in-progress SASL authentication.
+type sasl struct {
+	mech string
+	data string
+}
+
+// Maps users to their in-progress SASL authentications.
+var authenticating = make(map[*core.User]*sasl)
+var authMutex sync.Mutex
+
+// Supported SASL mechanisms.
+var mechanisms = []string{"PLAIN", "EXTERNAL"}
+
+
+func init() {
+	var c *irc.Command
+
+	// Add the SASL capability.
+	client.AddCap("sasl", strings.Join(mechanisms, ","))
+
+	// Add authenticate command.
+	c = new(irc.Command)
+	c.Name = "AUTHENTICATE"
+	c.Handler = cmdAuthenticate
+	c.Minargs = 1
+	c.Maxargs = 1
+	c.Unregged = 1
+	client.Commands.Add(c)
+
+	// Tell our clients when they log in or out.
+	core.HookUserDataChange("account", func(_ interface{}, source, target *core.User, oldvalue, newvalue string) {
+		nick := target.Nick()
+		if nick == "" {
+			nick = "*"
+		}
+		mask := nick + "!" + target.GetIdent() + "@" + client.Hostname(target, target)
+
+		for _, c := range client.GetClients(target) {
+			if newvalue != "" {
+				c.SendLineTo(nil, "900", "%s %s :You are now logged in as %s.", mask, newvalue, newvalue)
+			} else {
+				c.SendLineTo(nil, "901", "%s :You are now logged out.", mask)
+			}
+		}
+	},
+		true)
+
+	// Drop in-progress authentications of deleted users.
+	core.HookUserDelete(func(_ interface{}, source, u *core.User, message string) {
+		authMutex.Lock()
+		authenticating[u] = nil, false
+		authMutex.Unlock()
+	},
+		true)
+}
+
+func cmdAuthenticate(source interface{}, params [][]byte) {
+	c := source.(*client.Client)
+	u := c.User()
+	param := string(params[0])
+
+	if !c.HasCap("sasl") {
+		c.SendLineTo(nil, "904", ":SASL authentication failed.")
+		return
+	}
+
+	authMutex.Lock()
+	s := authenticating[u]
+	authMutex.Unlock()
+
+	// Handle aborts, whether or not they're authenticating.
+	if param == "*" {
+		if s != nil {
+			endAuth(u)
+		}
+		c.SendLineTo(nil, "906", ":SASL authentication aborted.")
+		return
+	}
+
+	// If this is the start of an authentication, it names a mechanism.
+	if s == nil {
+		if u.Data("account") != "" {
+			c.SendLineTo(nil, "907", ":You have already authenticated.")
+			return
+		}
+
+		mech := strings.ToUpper(param)
+		supported := false
+		for _, m := range mechanisms {
+			if m == mech {
+				supported = true
+			}
+		}
+		if !supported {
+			c.SendLineTo(nil, "908", "%s :are available SASL mechanisms", strings.Join(mechanisms, ","))
+			c.SendLineTo(nil, "904", ":SASL authentication failed.")
+			return
+		}
+
+		s = new(sasl)
+		s.mech = mech
+		authMutex.Lock()
+		authenticating[u] = s
+		authMutex.Unlock()
+
+		c.SendFrom(nil, "AUTHENTICATE +")
+		return
+	}
+
+	// Otherwise, it is part of their response.
+	if len(param) > saslChunk || len(s.data)+len(param) > saslMax {
+		endAuth(u)
+		c.SendLineTo(nil, "905", ":SASL message too long.")
+		return
+	}
+	if param != "+" {
+		s.data += param
+	}
+	if len(param) == saslChunk {
+		return
+	}
+	endAuth(u)
+
+	response, err := base64.StdEncoding.DecodeString(s.data)
+	if err != nil {
+		c.SendLineTo(nil, "904", ":SASL authentication failed.")
+		return
+	}
+
+	// Map the mechanism onto a login check.
+	var account, authtype, auth string
+	switch s.mech {
+	case "PLAIN":
+		// The response is authzid, authcid, and password, separated
+		// by NULs. We don't permit logging in as another account.
+		fields := strings.Split(string(response), "\x00", -1)
+		if len(fields) != 3 || (fields[0] != "" &&
+			strings.ToUpper(fields[0]) != strings.ToUpper(fields[1])) {
+			c.SendLineTo(nil, "904", ":SASL authentication failed.")
+			return
+		}
+		account, authtype, auth = fields[1], "password", fields[2]
+
+	case "EXTERNAL":
+		// The response is the authzid, if any, and they authenticate
+		// with their client certificate, if its fingerprint has been
+		// added to an account with CERTFP.
+		if u.Data("certfp") == "" {
+			c.SendLineTo(nil, "904", ":SASL authentication failed.")
+			return
+		}
+		account, authtype, auth = string(response), "certfp", u.Data("certfp")
+	}
+
+	if ok, err := perm.CheckLogin("", u, account, authtype, auth); ok {
+		u.SetData(nil, nil, "account", err.String())
+		c.SendLineTo(nil, "903", ":SASL authentication successful.")
+	} else {
+		c.SendLineTo(nil, "904", ":SASL authentication failed.")
+	}
+}
+
+// Ends a user's in-progress authentication.
+func endAuth(u *core.User) {
+	authMutex.Lock()
+	authenticating[u] = nil, false
+	authMutex.Unlock()
+}
@@ -26,8 +26,9 @@ func cmdOjoin(source interface{}, params [][]byte) {
 	}
 
 	ch := core.GetChannel("", channame)
-	if perm, err := perm.CheckJoinPerm("", c.User(), ch); perm < -1000000 {
+	if level, err := perm.CheckJoinPerm("", c.User(), ch); level < -1000000 {
 		c.SendLineTo(nil, "495", "#%s :%s", ch.Name(), err)
+		perm.DeleteEmpty("", c.User(), ch)
 		return
 	}
 
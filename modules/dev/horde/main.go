@@ -10,6 +10,7 @@ import "rand"
 import "time"
 
 import "oddcomm/src/core"
+import "oddcomm/lib/perm"
 
 
 var me string = "modules/dev/horde"
@@ -39,7 +40,7 @@ func addHorde() {
 	}
 
 	// Make a huge channel containing the entire horde.
-	core.GetChannel("", "huge").Join(me, horde)
+	addChannel("huge", horde)
 
 	// Make 100 channels containing roughly a twentieth of the horde each.
 	// Each horde user is in an average of roughly five.
@@ -49,7 +50,7 @@ func addHorde() {
 			joiners[i] = horde[rand.Int()%len(horde)]
 		}
 		name := fmt.Sprintf("big_%d", i)
-		core.GetChannel("", name).Join(me, joiners)
+		addChannel(name, joiners)
 	}
 
 	// Make 2000 channels containing roughly 1/400th of the horde each.
@@ -60,7 +61,7 @@ func addHorde() {
 			joiners[i] = horde[rand.Int()%len(horde)]
 		}
 		name := fmt.Sprintf("medium_%d", i)
-		core.GetChannel("", name).Join(me, joiners)
+		addChannel(name, joiners)
 	}
 
 	// Make horde*2 channels containing roughly four of the horde each.
@@ -71,6 +72,14 @@ func addHorde() {
 			joiners[i] = horde[rand.Int()%len(horde)]
 		}
 		name := fmt.Sprintf("small_%d", i)
-		core.GetChannel("", name).Join(me, joiners)
+		addChannel(name, joiners)
 	}
 }
+
+// Creates a channel with the given members, deleting it again as any other
+// emptied channel would be if none of them could join.
+func addChannel(name string, joiners []*core.User) {
+	ch := core.GetChannel("", name)
+	ch.Join(me, joiners)
+	perm.DeleteEmpty(me, nil, ch)
+}
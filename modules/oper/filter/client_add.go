@@ -0,0 +1,141 @@
+package filter
+
+import "strconv"
+import "strings"
+import "sync"
+
+import "oddcomm/src/client"
+import "oddcomm/src/core"
+import "oddcomm/lib/irc"
+import "oddcomm/lib/perm"
+
+
+// Our opers, to notice of filter matches.
+var opers = make(map[*core.User]bool)
+var operMutex sync.Mutex
+
+
+func init() {
+	c := new(irc.Command)
+	c.Name = "FILTER"
+	c.Handler = cmdFilter
+	c.Minargs = 0
+	c.Maxargs = 6
+	c.OperFlag = "filter"
+	client.Commands.Add(c)
+
+	// Act once per command, however many targets it has.
+	acted = make(map[*core.User]bool)
+	client.HookAfter("", func(c *client.Client, _ string, _ [][]byte) {
+		commandDone(c.User())
+	})
+
+	// Keep track of our opers.
+	core.HookUserDataChange("op", func(_ interface{}, _, target *core.User, _, newvalue string) {
+		operMutex.Lock()
+		if newvalue != "" && client.GetClients(target) != nil {
+			opers[target] = true
+		} else {
+			opers[target] = false, false
+		}
+		operMutex.Unlock()
+	},
+		true)
+	core.HookUserDelete(func(_ interface{}, _, u *core.User, _ string) {
+		operMutex.Lock()
+		opers[u] = false, false
+		operMutex.Unlock()
+	},
+		true)
+
+	// Notice our opers who can manage filters.
+	noticeOpers = func(message string) {
+		operMutex.Lock()
+		list := make([]*core.User, 0, len(opers))
+		for u := range opers {
+			list = append(list, u)
+		}
+		operMutex.Unlock()
+
+		for _, u := range list {
+			if !perm.HasOpFlag(u, nil, "filter") {
+				continue
+			}
+			for _, c := range client.GetClients(u) {
+				c.SendFrom(nil, "NOTICE %s :*** %s", u.Nick(), message)
+			}
+		}
+	}
+}
+
+
+// FILTER [LIST]
+// FILTER ADD <pattern> <targets> <action> [<duration>] [:<reason>]
+// FILTER DEL <id>
+//
+// Patterns may not contain spaces; globs can match them with ?, and regular
+// expressions with \s. The duration is given only for the ban action.
+func cmdFilter(source interface{}, params [][]byte) {
+	c := source.(*client.Client)
+	u := c.User()
+
+	subcommand := "LIST"
+	if len(params) > 0 {
+		subcommand = strings.ToUpper(string(params[0]))
+	}
+
+	switch subcommand {
+	case "LIST":
+		for _, f := range Filters() {
+			var duration string
+			if f.Action == "ban" {
+				duration = " " + strconv.Itoa64(f.Duration) + "s"
+			}
+			c.SendFrom(nil, "NOTICE %s :*** Filter %s: %s on %s, %s%s, %d hits: %s", u.Nick(), f.Id, f.Pattern, strings.Join(f.Targets, ","), f.Action, duration, f.Hits, f.Reason)
+		}
+		c.SendFrom(nil, "NOTICE %s :*** End of filter list.", u.Nick())
+
+	case "ADD":
+		if len(params) < 4 {
+			c.SendLineTo(nil, "461", "FILTER :Not enough parameters.")
+			return
+		}
+		action := string(params[3])
+		rest := params[4:]
+
+		var duration int64
+		if strings.ToLower(action) == "ban" && len(rest) > 0 {
+			if d, err := strconv.Atoi64(string(rest[0])); err == nil {
+				duration = d
+				rest = rest[1:]
+			}
+		}
+		var reason string
+		if len(rest) > 0 {
+			reason = string(rest[0])
+		}
+
+		targets := strings.Split(string(params[2]), ",", -1)
+		f, err := AddFilter(u, string(params[1]), targets, action, duration, reason)
+		if err != nil {
+			c.SendFrom(nil, "NOTICE %s :*** %s", u.Nick(), err)
+			return
+		}
+		c.SendFrom(nil, "NOTICE %s :*** Filter %s added.", u.Nick(), f.Id)
+
+	case "DEL":
+		if len(params) < 2 {
+			c.SendLineTo(nil, "461", "FILTER :Not enough parameters.")
+			return
+		}
+		id := string(params[1])
+		if !RemoveFilter(u, id) {
+			c.SendFrom(nil, "NOTICE %s :*** No such filter: %s", u.Nick(), id)
+			return
+		}
+		c.SendFrom(nil, "NOTICE %s :*** Filter %s removed.", u.Nick(), id)
+
+	default:
+		c.SendFrom(nil, "NOTICE %s :*** Unknown FILTER subcommand: %s", u.Nick(), subcommand)
+	}
+}
@@ -0,0 +1,412 @@
+/*
+	Implements network-wide filters on private messages, channel messages,
+	quit and part reasons, and nicks, which block, notice opers, kill, or
+	ban users on a match.
+
+	Filters are globs, or regular expressions written between slashes, and
+	are kept in global data, so they persist across restarts, along with how
+	many times each has matched on each server.
+*/
+package filter
+
+import "os"
+import "regexp"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+import "oddcomm/src/core"
+import msgfilter "oddcomm/lib/filter"
+import "oddcomm/lib/perm"
+
+
+var me string = "modules/oper/filter"
+
+// A filter, as stored.
+type Filter struct {
+	Id       string
+	Pattern  string   // A glob, or a regular expression between slashes.
+	Targets  []string // What the filter applies to.
+	Action   string   // What to do on a match.
+	Duration int64    // How long, in seconds, bans last.
+	Reason   string
+	Hits     int
+}
+
+// The things filters may apply to.
+var Targets = []string{"privmsg", "chanmsg", "quit", "part", "nick"}
+
+// The actions filters may take.
+var Actions = []string{"block", "notice", "kill", "ban"}
+
+// How long, in seconds, bans last if no duration is given.
+var DefaultDuration int64 = 3600
+
+// Called to notice opers of filter matches and changes. Does nothing unless
+// something which can send notices is built in.
+var noticeOpers = func(message string) {}
+
+// How often, in seconds, hits counted here are added to the stored counts,
+// and expired bans are removed.
+var HitInterval int64 = 60
+
+// Guards adding filters, the filter cache, counting hits, and the compiled
+// patterns.
+var mutex sync.Mutex
+var compiled = make(map[string]*regexp.Regexp)
+
+// The parsed filters, as of the stored "filterversion", which changes
+// whenever a filter is added or removed on any server.
+var cache []*Filter
+var cacheVersion string
+var cached bool
+
+// Hits counted here not yet added to the stored counts, by filter ID.
+var hits = make(map[string]int)
+
+// Users who have already hit a filter in the command they are running, so
+// a command with several targets takes one action. If nil, every hit acts.
+// Cleared after each command by whatever runs them.
+var acted map[*core.User]bool
+
+
+func init() {
+	msgfilter.HookUserMsg(false, 200, true, "", func(source, _ *core.User, message []byte) ([]byte, os.Error) {
+		return message, check(source, "privmsg", string(message))
+	})
+	msgfilter.HookChanMsg(false, 200, true, "", func(source *core.User, _ *core.Channel, _ *core.User, message []byte) ([]byte, os.Error) {
+		return message, check(source, "chanmsg", string(message))
+	})
+	msgfilter.HookQuit(false, 200, func(source, _ *core.User, reason []byte) ([]byte, os.Error) {
+		return reason, check(source, "quit", string(reason))
+	})
+	msgfilter.HookPart(false, 200, func(source *core.User, _ *core.Channel, _ *core.User, reason []byte) ([]byte, os.Error) {
+		return reason, check(source, "part", string(reason))
+	})
+	perm.HookCheckNick(func(_ string, u *core.User, nick string) (int, os.Error) {
+		if err := check(u, "nick", nick); err != nil {
+			return -1000000, err
+		}
+		return 0, nil
+	})
+
+	core.HookStart(func() { go flushHits() })
+
+	// Disconnect banned users as they register.
+	core.HookUserRegister(func(_ interface{}, u *core.User) {
+		if reason := banned(u.Data("ip")); reason != "" {
+			u.Delete(me, nil, "Banned: "+reason)
+		}
+	})
+}
+
+
+// Filters returns every filter.
+func Filters() []*Filter {
+	filters := current()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	list := make([]*Filter, len(filters))
+	for i, f := range filters {
+		entry := *f
+		core.Global.DataRange("filterhits "+f.Id+" ", func(_, value string) {
+			n, _ := strconv.Atoi(value)
+			entry.Hits += n
+		})
+		entry.Hits += hits[f.Id]
+		list[i] = &entry
+	}
+	return list
+}
+
+// AddFilter adds a filter, returning it, or an error if it is invalid.
+// Targets may include "all" for every target. The duration is ignored
+// unless the action is ban, and zero for DefaultDuration.
+func AddFilter(source *core.User, pattern string, targets []string, action string, duration int64, reason string) (*Filter, os.Error) {
+	if pattern == "" || strings.IndexAny(pattern, " \r\n") != -1 {
+		return nil, os.NewError("Patterns may not be empty or contain spaces.")
+	}
+	if _, err := match(pattern, ""); err != nil {
+		return nil, os.NewError("Invalid regular expression: " + err.String())
+	}
+
+	var valid []string
+	for _, t := range targets {
+		t = strings.ToLower(t)
+		if t == "all" {
+			valid = Targets
+			break
+		}
+		if !contains(Targets, t) {
+			return nil, os.NewError("Unknown filter target: " + t)
+		}
+		valid = append(valid, t)
+	}
+	if len(valid) == 0 {
+		return nil, os.NewError("No filter targets given.")
+	}
+
+	action = strings.ToLower(action)
+	if !contains(Actions, action) {
+		return nil, os.NewError("Unknown filter action: " + action)
+	}
+	if action != "ban" {
+		duration = 0
+	} else if duration <= 0 {
+		duration = DefaultDuration
+	}
+	if reason == "" {
+		reason = "Filtered"
+	}
+
+	f := new(Filter)
+	f.Pattern = pattern
+	f.Targets = valid
+	f.Action = action
+	f.Duration = duration
+	f.Reason = reason
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	// Take the next unused ID.
+	var last int
+	core.Global.DataRange("filter ", func(name, _ string) {
+		if id, _ := strconv.Atoi(name[len("filter "):]); id > last {
+			last = id
+		}
+	})
+	f.Id = strconv.Itoa(last + 1)
+
+	core.Global.SetData(me, source, "filter "+f.Id, strings.Join(f.Targets, ",")+" "+f.Action+" "+strconv.Itoa64(f.Duration)+" "+f.Pattern+" :"+f.Reason)
+	changed(source)
+	return f, nil
+}
+
+// RemoveFilter removes the filter with the given ID, returning whether it
+// existed.
+func RemoveFilter(source *core.User, id string) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if core.Global.Data("filter "+id) == "" {
+		return false
+	}
+	core.Global.SetData(me, source, "filter "+id, "")
+	for _, name := range names("filterhits " + id + " ") {
+		core.Global.SetData(me, source, name, "")
+	}
+	hits[id] = 0, false
+	changed(source)
+	return true
+}
+
+// Marks the stored filters as changed, so every server reparses them.
+// Must be called while holding the mutex.
+func changed(source *core.User) {
+	version, _ := strconv.Atoi64(core.Global.Data("filterversion"))
+	core.Global.SetData(me, source, "filterversion", strconv.Itoa64(version+1))
+}
+
+// Returns the parsed filters, reparsing them if they have changed.
+func current() []*Filter {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	version := core.Global.Data("filterversion")
+	if cached && version == cacheVersion {
+		return cache
+	}
+
+	cache = nil
+	core.Global.DataRange("filter ", func(name, value string) {
+		if f := parse(name[len("filter "):], value); f != nil {
+			cache = append(cache, f)
+		}
+	})
+	cacheVersion = version
+	cached = true
+	return cache
+}
+
+// Adds the hits counted here to the stored counts every HitInterval, so
+// matches don't each write to the network, and removes expired bans.
+// Each server stores its own counts, as "filterhits <id> <server>", so no
+// other server writes them between our reading and updating them.
+func flushHits() {
+	for {
+		time.Sleep(HitInterval * 1e9)
+
+		mutex.Lock()
+		server := core.Global.Data("name")
+		for id, n := range hits {
+			if core.Global.Data("filter "+id) != "" {
+				name := "filterhits " + id + " " + server
+				stored, _ := strconv.Atoi(core.Global.Data(name))
+				core.Global.SetData(me, nil, name, strconv.Itoa(stored+n))
+			}
+			hits[id] = 0, false
+		}
+		mutex.Unlock()
+
+		now := time.Seconds()
+		for _, name := range names("filterban ") {
+			if expiry(core.Global.Data(name)) <= now {
+				core.Global.SetData(me, nil, name, "")
+			}
+		}
+	}
+}
+
+// Returns the names of the global data with the given prefix, so they can
+// be changed after ranging over them.
+func names(prefix string) []string {
+	var list []string
+	core.Global.DataRange(prefix, func(name, _ string) {
+		list = append(list, name)
+	})
+	return list
+}
+
+
+// Parses a stored filter.
+func parse(id, value string) *Filter {
+	fields := strings.Split(value, " ", 5)
+	if len(fields) != 5 || len(fields[4]) == 0 || fields[4][0] != ':' {
+		return nil
+	}
+
+	f := new(Filter)
+	f.Id = id
+	f.Targets = strings.Split(fields[0], ",", -1)
+	f.Action = fields[1]
+	f.Duration, _ = strconv.Atoi64(fields[2])
+	f.Pattern = fields[3]
+	f.Reason = fields[4][1:]
+	return f
+}
+
+// Checks the given text from a user against the filters for the given
+// target, taking the action of the first matching. Returns an error if it
+// should be blocked.
+func check(u *core.User, target, text string) os.Error {
+	if u == nil {
+		return nil
+	}
+
+	for _, f := range current() {
+		if !contains(f.Targets, target) {
+			continue
+		}
+		if ok, _ := match(f.Pattern, text); ok {
+			return act(u, f, target)
+		}
+	}
+
+	return nil
+}
+
+// Returns whether the text matches the given pattern; a glob, or a regular
+// expression between slashes.
+func match(pattern, text string) (bool, os.Error) {
+	if len(pattern) < 2 || pattern[0] != '/' || pattern[len(pattern)-1] != '/' {
+		return perm.GMatch(text, pattern), nil
+	}
+
+	mutex.Lock()
+	re, ok := compiled[pattern]
+	mutex.Unlock()
+	if !ok {
+		var err os.Error
+		if re, err = regexp.Compile(pattern[1 : len(pattern)-1]); err != nil {
+			return false, err
+		}
+		mutex.Lock()
+		compiled[pattern] = re
+		mutex.Unlock()
+	}
+
+	return re.MatchString(text), nil
+}
+
+// Counts a hit on a filter by a user, and takes its action, unless they
+// already hit a filter in this command. Returns an error if what matched
+// should be blocked.
+func act(u *core.User, f *Filter, target string) os.Error {
+	err := os.NewError("Blocked by filter: " + f.Reason)
+	if f.Action == "notice" {
+		err = nil
+	}
+
+	mutex.Lock()
+	if acted != nil {
+		if acted[u] {
+			mutex.Unlock()
+			return err
+		}
+		acted[u] = true
+	}
+	hits[f.Id]++
+	mutex.Unlock()
+
+	noticeOpers("Filter " + f.Id + " (" + f.Action + ") matched " + target + " from " + u.Nick() + "!" + u.GetIdent() + "@" + u.GetHostname() + ": " + f.Reason)
+
+	switch f.Action {
+	case "ban":
+		expiry := time.Seconds() + f.Duration
+		core.Global.SetData(me, nil, "filterban "+u.Data("ip"), strconv.Itoa64(expiry)+" "+f.Reason)
+		fallthrough
+	case "kill":
+		// Quitting users are leaving anyway.
+		if target != "quit" {
+			go u.Delete(me, nil, "Filtered: "+f.Reason)
+		}
+	}
+
+	return err
+}
+
+// Notes a user's command has finished, so their next can act on a hit.
+func commandDone(u *core.User) {
+	mutex.Lock()
+	acted[u] = false, false
+	mutex.Unlock()
+}
+
+// Returns the reason the given IP is banned by a filter, or "" if it isn't.
+// Expired bans are ignored until flushHits removes them.
+func banned(ip string) string {
+	if ip == "" {
+		return ""
+	}
+	ban := core.Global.Data("filterban " + ip)
+	if ban == "" || expiry(ban) <= time.Seconds() {
+		return ""
+	}
+
+	fields := strings.Split(ban, " ", 2)
+	if len(fields) < 2 {
+		return "Filtered"
+	}
+	return fields[1]
+}
+
+// Returns the time, in seconds, a stored ban expires.
+func expiry(ban string) int64 {
+	fields := strings.Split(ban, " ", 2)
+	expiry, _ := strconv.Atoi64(fields[0])
+	return expiry
+}
+
+// Returns whether the list contains the string.
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
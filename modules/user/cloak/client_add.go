@@ -0,0 +1,22 @@
+package cloak
+
+import "oddcomm/src/client"
+import "oddcomm/src/core"
+
+func init() {
+	client.UserModes.AddSimple('x', "cloaked")
+	client.AddHostHook(Host)
+
+	// Tell our clients when their displayed host changes.
+	for _, name := range []string{"cloaked", "vhost"} {
+		core.HookUserDataChange(name, func(_ interface{}, source, target *core.User, oldvalue, newvalue string) {
+			if !target.Registered() {
+				return
+			}
+			for _, c := range client.GetClients(target) {
+				c.SendLineTo(nil, "396", "%s :is now your displayed host", client.Hostname(target, target))
+			}
+		},
+			false)
+	}
+}
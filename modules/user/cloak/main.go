@@ -0,0 +1,151 @@
+/*
+	Hides the hostnames of users who opt in behind stable cloaks, derived
+	from their IP or hostname with a keyed HMAC, and gives users logged
+	into accounts with vhosts their vhost.
+
+	Opers with the viewusers flag still see real hostnames.
+*/
+package cloak
+
+import "crypto/hmac"
+import "crypto/rand"
+import "crypto/sha256"
+import "encoding/hex"
+import "io"
+import "net"
+import "os"
+import "strings"
+
+import "oddcomm/src/core"
+import "oddcomm/lib/perm"
+
+
+var me string = "modules/user/cloak"
+
+// The key cloaks are derived with. Must be the same on every server for
+// cloaks to match, and kept secret, or anyone can check guesses at the host
+// behind a cloak. If unset, a random key is generated once for the network,
+// and kept in global data as "cloakkey".
+var Key string
+
+// Prefix for cloaked hostnames.
+var Prefix string = "oddcomm"
+
+// Maps accounts to vhosts.
+var vhosts map[string]string
+
+
+func init() {
+	core.HookStart(func() {
+		if Key != "" || core.Global.Data("cloakkey") != "" {
+			return
+		}
+
+		buf := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+			panic(err)
+		}
+		core.Global.SetData(me, nil, "cloakkey", hex.EncodeToString(buf))
+	})
+
+	vhosts = make(map[string]string)
+
+	// Here, we would load things in from the config.
+	vhosts["TESTACCOUNT"] = "test.account"
+
+	// Users can cloak themselves.
+	perm.HookCheckUserData("cloaked", func(_ string, source, target *core.User, _, _ string) (int, os.Error) {
+		if source == target {
+			return 100, nil
+		}
+		return 0, nil
+	})
+
+	// Keep users' cloaks up to date with their hostname.
+	core.HookUserRegister(func(_ interface{}, u *core.User) {
+		setCloak(u)
+	})
+	core.HookUserDataChange("hostname", func(_ interface{}, source, target *core.User, oldvalue, newvalue string) {
+		setCloak(target)
+	},
+		true)
+
+	// Give users logged into accounts with vhosts their vhost.
+	core.HookUserDataChange("account", func(_ interface{}, source, target *core.User, oldvalue, newvalue string) {
+		if vhost := vhosts[strings.ToUpper(newvalue)]; vhost != target.Data("vhost") {
+			target.SetData(nil, nil, "vhost", vhost)
+		}
+	},
+		true)
+}
+
+
+// Host returns the hostname of the given user shown to the given viewing
+// user; their vhost if they have one, their cloak if they're cloaked, or ""
+// for their real hostname.
+func Host(viewer, u *core.User) string {
+	if viewer != nil && viewer != u && perm.HasOpFlag(viewer, nil, "viewusers") {
+		return ""
+	}
+	if vhost := u.Data("vhost"); vhost != "" {
+		return vhost
+	}
+	if u.Data("cloaked") != "" {
+		return u.Data("cloak")
+	}
+	return ""
+}
+
+// Sets a user's cloak from their current hostname.
+func setCloak(u *core.User) {
+	if cloak := Cloak(u.Data("ip"), u.GetHostname()); cloak != u.Data("cloak") {
+		u.SetData(nil, nil, "cloak", cloak)
+	}
+}
+
+// Cloak returns the cloak for the given IP and hostname. If the hostname is
+// the IP, the IP is cloaked, with the cloak ending in hashes of its network
+// prefixes so ranges can be banned; otherwise, the hostname's first label
+// is replaced by a hash.
+func Cloak(ip, hostname string) string {
+	addr := net.ParseIP(ip)
+	if hostname == "" || hostname == ip {
+		if addr == nil {
+			return ""
+		}
+
+		// Hash the address and two prefixes of it.
+		var raw []byte
+		var lengths []int
+		if v4 := addr.To4(); v4 != nil {
+			raw, lengths = v4, []int{4, 3, 2}
+		} else {
+			raw, lengths = addr.To16(), []int{16, 8, 6}
+		}
+
+		var parts []string
+		for _, length := range lengths {
+			parts = append(parts, hash(raw[:length]))
+		}
+		return strings.Join(parts, ".") + ".IP"
+	}
+
+	labels := strings.Split(hostname, ".", -1)
+	cloak := Prefix + "-" + hash([]byte(hostname))
+	if len(labels) > 2 {
+		return cloak + "." + strings.Join(labels[1:], ".")
+	}
+	return cloak + "." + labels[len(labels)-1]
+}
+
+// Returns a short hash of the given data with the key.
+func hash(data []byte) string {
+	key := Key
+	if key == "" {
+		key = core.Global.Data("cloakkey")
+	}
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(data)
+	return strings.ToUpper(hex.EncodeToString(mac.Sum()[:4]))
+}
@@ -0,0 +1,259 @@
+package client
+
+import "strconv"
+import "strings"
+import "time"
+
+import "oddcomm/src/core"
+import "oddcomm/lib/irc"
+
+
+// A capability clients may request.
+type capability struct {
+	name  string
+	value string
+	h     func() string
+}
+
+// Capabilities clients may request, in the order they were added.
+var caps []*capability
+
+
+func init() {
+	// Add core capabilities.
+	AddCap("message-tags", "")
+	AddCap("server-time", "")
+	AddCap("account-tag", "")
+
+	c := new(irc.Command)
+	c.Name = "CAP"
+	c.Handler = cmdCap
+	c.Minargs = 1
+	c.Maxargs = 2
+	c.Unregged = 1
+	Commands.Add(c)
+}
+
+
+// Adds the given capability to those clients may request. If value is
+// non-empty, it is sent to clients listing capabilities with CAP LS 302.
+// May only be used during init.
+func AddCap(name, value string) {
+	c := new(capability)
+	c.name = name
+	c.value = value
+	caps = append(caps, c)
+}
+
+// Adds the given capability to those clients may request, with its value
+// given by calling the given function whenever clients list capabilities.
+// May only be used during init.
+func AddCapHook(name string, h func() string) {
+	c := new(capability)
+	c.name = name
+	c.h = h
+	caps = append(caps, c)
+}
+
+// HasCap returns whether the client has enabled the given capability.
+func (c *Client) HasCap(name string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.caps[name]
+}
+
+// Returns the capability with the given name, or nil if there is none.
+func getCap(name string) *capability {
+	for _, c := range caps {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Capabilities which enable individual message tags without message-tags.
+// Other tags are only sent to clients with message-tags.
+var tagCaps = map[string]string{
+	"time":    "server-time",
+	"account": "account-tag",
+	"msgid":   "message-tags",
+	"label":   "labeled-response",
+}
+
+// Returns the message tags to send a client, given the tags a line from the
+// given source user has and the client's capabilities. Adds the server time
+// and the source's account, if the client has enabled them.
+func (c *Client) tagsFor(tags irc.Tags, u *core.User) irc.Tags {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	newtags := make(irc.Tags)
+	for name, value := range tags {
+		if capName, ok := tagCaps[name]; ok {
+			if c.caps[capName] {
+				newtags[name] = value
+			}
+		} else if c.caps["message-tags"] {
+			newtags[name] = value
+		}
+	}
+
+	if c.caps["server-time"] && newtags["time"] == "" {
+		newtags["time"] = irc.ServerTime(time.Nanoseconds())
+	}
+	if c.caps["account-tag"] && newtags["account"] == "" && u != nil {
+		if account := u.Data("account"); account != "" {
+			newtags["account"] = account
+		}
+	}
+
+	if len(newtags) == 0 {
+		return nil
+	}
+	return newtags
+}
+
+// Completes our part of a client's registration, once they have sent USER and
+// finished any capability negotiation. Whether they attach to an existing
+// session is decided once they have registered, after every other hold.
+func register(c *Client) {
+	c.mutex.Lock()
+	capping := c.capping
+	c.mutex.Unlock()
+
+	if c.u.Data("ident") == "" || capping {
+		return
+	}
+
+	// Place them in their class now we know their address and account.
+	if !setClass(c) {
+		return
+	}
+
+	c.u.PermitRegistration(me)
+}
+
+
+func cmdCap(source interface{}, params [][]byte) {
+	c := source.(*Client)
+
+	nick := c.u.Nick()
+	if nick == "" {
+		nick = "*"
+	}
+
+	subcmd := strings.ToUpper(string(params[0]))
+	switch subcmd {
+	case "LS":
+		if len(params) > 1 {
+			if version, err := strconv.Atoi(string(params[1])); err == nil && version >= 302 {
+				c.mutex.Lock()
+				c.capVersion = version
+				c.mutex.Unlock()
+			}
+		}
+		capHold(c)
+
+		c.mutex.Lock()
+		values := c.capVersion >= 302
+		c.mutex.Unlock()
+
+		var list []string
+		for _, capab := range caps {
+			token := capab.name
+			value := capab.value
+			if capab.h != nil {
+				value = capab.h()
+			}
+			if values && value != "" {
+				token += "=" + value
+			}
+			list = append(list, token)
+		}
+
+		// Split long lists over several lines, if the client can
+		// handle it.
+		line := ""
+		for _, token := range list {
+			if values && line != "" && len(line)+len(token) > 400 {
+				c.SendFrom(nil, "CAP %s LS * :%s", nick, line)
+				line = ""
+			}
+			if line != "" {
+				line += " "
+			}
+			line += token
+		}
+		c.SendFrom(nil, "CAP %s LS :%s", nick, line)
+
+	case "LIST":
+		c.mutex.Lock()
+		var list []string
+		for _, capab := range caps {
+			if c.caps[capab.name] {
+				list = append(list, capab.name)
+			}
+		}
+		c.mutex.Unlock()
+
+		c.SendFrom(nil, "CAP %s LIST :%s", nick, strings.Join(list, " "))
+
+	case "REQ":
+		if len(params) < 2 {
+			c.SendLineTo(nil, "461", "CAP :Not enough parameters.")
+			return
+		}
+		capHold(c)
+
+		// Requests succeed or fail as a whole.
+		requested := strings.Fields(string(params[1]))
+		for _, name := range requested {
+			if getCap(strings.TrimLeft(name, "-")) == nil {
+				c.SendFrom(nil, "CAP %s NAK :%s", nick, params[1])
+				return
+			}
+		}
+
+		c.mutex.Lock()
+		if c.caps == nil {
+			c.caps = make(map[string]bool)
+		}
+		for _, name := range requested {
+			if name[0] == '-' {
+				c.caps[name[1:]] = false, false
+			} else {
+				c.caps[name] = true
+			}
+		}
+		c.mutex.Unlock()
+
+		c.SendFrom(nil, "CAP %s ACK :%s", nick, params[1])
+
+	case "END":
+		c.mutex.Lock()
+		capping := c.capping
+		c.capping = false
+		c.mutex.Unlock()
+
+		if capping {
+			register(c)
+		}
+
+	default:
+		c.SendLineTo(nil, "410", "%s :Invalid CAP command.", params[0])
+	}
+}
+
+// Holds a client's registration until they end capability negotiation, if
+// they have not yet registered.
+func capHold(c *Client) {
+	if c.u.Registered() {
+		return
+	}
+
+	c.mutex.Lock()
+	c.capping = true
+	c.mutex.Unlock()
+}
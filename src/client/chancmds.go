@@ -3,6 +3,7 @@ package client
 import "strings"
 
 import "oddcomm/src/core"
+import "oddcomm/lib/filter"
 import "oddcomm/lib/irc"
 import "oddcomm/lib/perm"
 
@@ -18,6 +19,7 @@ func init() {
 	c.Handler = cmdJoin
 	c.Minargs = 1
 	c.Maxargs = 1
+	c.Cost = 2000
 	Commands.Add(c)
 
 	c = new(irc.Command)
@@ -67,8 +69,15 @@ func cmdJoin(source interface{}, params [][]byte) {
 				continue
 			}
 
-			// Tell them they're joined.
+			// Tell them they're joined, along with their other
+			// sessions.
 			c.SendFrom(c.u, "JOIN #%s", ch.Name())
+			for _, other := range GetClients(c.u) {
+				if other != c {
+					other.SendFrom(c.u, "JOIN #%s", ch.Name())
+					sendJoinInfo(other, ch)
+				}
+			}
 
 			// Send them NAMES.
 			cmdNames(c, [][]byte{[]byte(ch.Name())})
@@ -81,6 +90,9 @@ func cmdJoin(source interface{}, params [][]byte) {
 			}
 		} else {
 			c.SendLineTo(nil, "495", "#%s :%s", ch.Name(), err)
+
+			// Don't leave behind a channel made just to refuse them.
+			perm.DeleteEmpty(me, c.u, ch)
 		}
 	}
 }
@@ -98,7 +110,10 @@ func cmdPart(source interface{}, params [][]byte) {
 		if ch := core.FindChannel("", channame); ch != nil {
 			var message string
 			if len(params) > 1 {
-				message = string(params[1])
+				reason, err := filter.Part(c.u, ch, params[1])
+				if err == nil {
+					message = string(reason)
+				}
 			}
 			ch.Remove(me, c.u, c.u, message)
 		}
@@ -0,0 +1,299 @@
+package client
+
+import "fmt"
+import "net"
+import "strconv"
+import "strings"
+import "sync"
+
+import "oddcomm/lib/irc"
+import "oddcomm/lib/perm"
+
+
+// Class is a connection class, setting limits for the clients in it.
+// Zero limits are unlimited, or for buffer sizes, timeouts and flood control,
+// the defaults.
+type Class struct {
+	// The class's name, used by listeners to place clients in it.
+	Name string
+
+	// IPs of clients in the class; glob masks, or CIDR ranges such as
+	// "10.0.0.0/8". Clients logged into any of the accounts are also in it.
+	IPs      []string
+	Accounts []string
+
+	// The most bytes of output we buffer for, and input we read ahead
+	// from, a client, before disconnecting them.
+	SendQ int
+	RecvQ int
+
+	// The most clients permitted from one IP, and from one range of IPs,
+	// with the given prefix lengths for IPv4 and IPv6 addresses.
+	MaxPerIP   int
+	MaxPerCIDR int
+	CIDRv4     int
+	CIDRv6     int
+
+	// How long, in seconds, clients have to register, and may be idle
+	// before being pinged.
+	RegTimeout    int64
+	PingFrequency int64
+
+	// Flood control burst and maximum, in milliseconds of penalty, and
+	// whether clients in the class are exempt from flood control.
+	FloodBurst int64
+	FloodMax   int64
+	NoFlood    bool
+}
+
+// Connection classes, checked in order for the first a client is in.
+// May only be changed before starting the subsystem.
+var Classes []*Class
+
+// The class for clients in no other class.
+var DefaultClass = &Class{
+	Name:       "default",
+	SendQ:      8192,
+	RecvQ:      2096 + irc.MaxClientTagData,
+	CIDRv4:     24,
+	CIDRv6:     64,
+	RegTimeout: 60,
+}
+
+
+// Returns the class a client belongs in. The listener they connected to
+// decides it if it names a class; otherwise, it's the first class matching
+// their IP or account.
+func classFor(c *Client) *Class {
+	if c.listener != nil && c.listener.Class != "" {
+		for _, class := range Classes {
+			if class.Name == c.listener.Class {
+				return class
+			}
+		}
+		return DefaultClass
+	}
+
+	u := c.User()
+	ip := u.Data("ip")
+	account := strings.ToUpper(u.Data("account"))
+	for _, class := range Classes {
+		for _, mask := range class.IPs {
+			if matchIP(ip, mask) {
+				return class
+			}
+		}
+		for _, a := range class.Accounts {
+			if account != "" && strings.ToUpper(a) == account {
+				return class
+			}
+		}
+	}
+
+	return DefaultClass
+}
+
+// Returns the client's class.
+func (c *Client) getClass() *Class {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.class == nil {
+		return DefaultClass
+	}
+	return c.class
+}
+
+// Returns the most input we read ahead from the client, for their class.
+func (c *Client) recvQ() int {
+	if class := c.getClass(); class.RecvQ != 0 {
+		return class.RecvQ
+	}
+	return DefaultClass.RecvQ
+}
+
+// Returns the largest RecvQ of any class, so a client's input buffer can
+// hold their class's RecvQ whichever class they end up in.
+func maxRecvQ() int {
+	max := DefaultClass.RecvQ
+	for _, class := range Classes {
+		if class.RecvQ > max {
+			max = class.RecvQ
+		}
+	}
+	return max
+}
+
+// Held while using client counts, and the keys clients are counted under,
+// which also need the client's mutex held. Must be taken after a client's
+// mutex, if both are.
+var countMutex sync.Mutex
+
+// Counts of clients in each class from each IP, and each range of IPs, for
+// classes with limits on them, keyed by "<class> <address>".
+var perIP = make(map[string]int)
+var perCIDR = make(map[string]int)
+
+// Places a client in their class, and checks they are within its limit on
+// clients per IP and range of IPs. If not, disconnects them and returns false.
+// Called once they've connected, and again whenever their address or account
+// may have changed, counting them against their current class and address.
+func setClass(c *Client) bool {
+	class := classFor(c)
+	ip := net.ParseIP(c.User().Data("ip"))
+
+	var ipKey, cidrKey string
+	if ip != nil && class.MaxPerIP != 0 {
+		ipKey = class.Name + " " + ip.String()
+	}
+	if ip != nil && class.MaxPerCIDR != 0 {
+		bits := class.CIDRv6
+		if ip.To4() != nil {
+			bits = class.CIDRv4
+		}
+		cidrKey = class.Name + " " + networkOf(ip, bits)
+	}
+
+	// Stop counting them where they were, then count them where they are
+	// now, if there is room. Clients already disconnecting aren't counted
+	// again.
+	var reason string
+	c.mutex.Lock()
+	if c.disconnecting&1 != 0 {
+		c.mutex.Unlock()
+		return false
+	}
+	c.class = class
+	countMutex.Lock()
+	uncount(c)
+	if ipKey != "" && perIP[ipKey] >= class.MaxPerIP {
+		reason = fmt.Sprintf("Too many connections from your IP (%d)", class.MaxPerIP)
+	} else if cidrKey != "" && perCIDR[cidrKey] >= class.MaxPerCIDR {
+		reason = fmt.Sprintf("Too many connections from your network (%d)", class.MaxPerCIDR)
+	} else {
+		if ipKey != "" {
+			perIP[ipKey]++
+		}
+		if cidrKey != "" {
+			perCIDR[cidrKey]++
+		}
+		c.ipKey, c.cidrKey = ipKey, cidrKey
+	}
+	countMutex.Unlock()
+	c.mutex.Unlock()
+
+	if reason == "" {
+		return true
+	}
+
+	c.SendLineTo(nil, "465", ":%s.", reason)
+	c.mutex.Lock()
+	c.delete(reason)
+	c.mutex.Unlock()
+	return false
+}
+
+// Stops counting a client against their class's per-IP and per-range limits.
+// Must be called while holding the count mutex.
+func uncount(c *Client) {
+	if c.ipKey != "" {
+		perIP[c.ipKey]--
+		if perIP[c.ipKey] <= 0 {
+			perIP[c.ipKey] = 0, false
+		}
+	}
+	if c.cidrKey != "" {
+		perCIDR[c.cidrKey]--
+		if perCIDR[c.cidrKey] <= 0 {
+			perCIDR[c.cidrKey] = 0, false
+		}
+	}
+	c.ipKey, c.cidrKey = "", ""
+}
+
+// Disconnects a client if they've not registered once their class's
+// registration timeout has passed. Run in its own goroutine once a client has
+// connected.
+func regTimeout(c *Client) {
+	timeout := c.getClass().RegTimeout
+	if timeout == 0 {
+		return
+	}
+	if !c.wait(timeout * 1e9) {
+		return
+	}
+
+	c.mutex.Lock()
+	if c.disconnecting&1 == 0 && !c.u.Registered() {
+		c.delete(fmt.Sprintf("Registration timed out (%d seconds)", timeout))
+	}
+	c.mutex.Unlock()
+}
+
+// Returns whether the given IP matches the given mask; a glob mask, or a CIDR
+// range.
+func matchIP(ip, mask string) bool {
+	slash := strings.Index(mask, "/")
+	if slash == -1 {
+		return perm.GMatch(ip, mask)
+	}
+
+	network := net.ParseIP(mask[:slash])
+	bits, err := strconv.Atoi(mask[slash+1:])
+	addr := net.ParseIP(ip)
+	if network == nil || err != nil || addr == nil {
+		return false
+	}
+	return sameNetwork(addr, network, bits)
+}
+
+// Returns the network the given IP is in, with the given prefix length, as
+// its first address. IPv4 prefix lengths are of the IPv4 address.
+func networkOf(ip net.IP, bits int) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		ip = ip.To16()
+	}
+
+	network := make(net.IP, len(ip))
+	for i := range ip {
+		if bits >= 8 {
+			network[i] = ip[i]
+			bits -= 8
+		} else if bits > 0 {
+			network[i] = ip[i] &^ (0xff >> uint(bits))
+			bits = 0
+		}
+	}
+	return network.String()
+}
+
+// Returns whether two IPs are in the same network, with the given prefix
+// length. IPv4 prefix lengths are of the IPv4 address.
+func sameNetwork(a, b net.IP, bits int) bool {
+	if a4, b4 := a.To4(), b.To4(); a4 != nil || b4 != nil {
+		if a4 == nil || b4 == nil {
+			return false
+		}
+		a, b = a4, b4
+	} else {
+		a, b = a.To16(), b.To16()
+	}
+
+	if bits > len(a)*8 {
+		bits = len(a) * 8
+	}
+	for i := 0; bits > 0; i++ {
+		mask := byte(0xFF)
+		if bits < 8 {
+			mask <<= uint(8 - bits)
+		}
+		if a[i]&mask != b[i]&mask {
+			return false
+		}
+		bits -= 8
+	}
+
+	return true
+}
@@ -12,20 +12,48 @@ import "oddcomm/lib/irc"
 // Handle a client connection.
 type Client struct {
 	mutex         sync.Mutex
-	conn          *net.TCPConn
+	conn          net.Conn
+	listener      *Listener
 	u             *core.User
 	outbuf        []byte
 	outcount      int
 	outchan       chan bool
+	done          chan bool // Closed once the client is disconnecting.
 	disconnecting uint8
 	nicked        bool
+	webirced      bool
+	ident         string // Ident looked up from their ident server.
+	lastInput     int64  // When we last got input, in nanoseconds.
+	pinged        bool   // Whether we've pinged them since then.
+	cookie        string // Cookie they must echo to register, if any.
+	penalty       int64  // Flood control penalty, in milliseconds.
+	penaltyAt     int64  // When penalty was last drained, in milliseconds.
+	lagged        int64  // Penalty of commands delayed in a row.
+	class         *Class
+	ipKey         string // Per-IP count they're in, if any.
+	cidrKey       string // Per-range count they're in, if any.
+	caps          map[string]bool
+	capVersion    int
+	capping       bool
+	tags          irc.Tags // Tags of the line being handled, if any.
 }
 
-// User returns this client's user.
+// User returns this client's user. This changes if the client attaches to
+// an existing session, so it must not be called with the client mutex held.
 func (c *Client) User() *core.User {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	return c.u
 }
 
+// Tags returns the message tags of the line from this client currently being
+// handled, or nil if it has none. May only be called from command handlers
+// and hooks run for the client's commands.
+func (c *Client) Tags() irc.Tags {
+	return c.tags
+}
+
 // Disconnects the client with the given message. This internal method assumes
 // it is being called with the client mutex already held.
 //
@@ -37,15 +65,29 @@ func (c *Client) User() *core.User {
 // The client is fully deleted when this method is called when the output
 // buffer is empty, and the input goroutine has terminated.
 func (c *Client) delete(message string) {
+	c.deleteFrom(nil, message, message)
+}
+
+// Disconnects the client as delete does, with the given source user deleting
+// their user, if any, with the given reason, and the given message sent to
+// the client. Used when the user quits, or is removed by another user.
+func (c *Client) deleteFrom(source *core.User, reason, message string) {
 
 	// First deletion only stuff.
 	if c.disconnecting&1 == 0 {
 
-		// Mark us as disconnecting.
+		// Mark us as disconnecting, and stop anything waiting on us.
 		c.disconnecting |= 1
+		close(c.done)
 
-		// If the user has not already been deleted, delete it.
-		c.u.Delete(me, nil, message)
+		// Stop counting us against our class's limits.
+		countMutex.Lock()
+		uncount(c)
+		countMutex.Unlock()
+
+		// Detach from the user, deleting it if this was its last
+		// session and it has not already been deleted.
+		detach(c, source, reason)
 	}
 
 	// Send them a goodbye message if we've not already sent one.
@@ -58,7 +100,7 @@ func (c *Client) delete(message string) {
 			username = "unknown"
 		}
 		c.write([]byte(fmt.Sprintf("ERROR :Closing link: (%s@%s) [%s]\r\n", username, c.u.Data("hostname"), message)))
-		c.disconnecting &= 2
+		c.disconnecting |= 2
 	}
 
 	// If the output buffer is done...
@@ -97,7 +139,7 @@ func (c *Client) write(line []byte) bool {
 			// Suppress output prior to calling delete, so it
 			// does not attempt to send a quit message.
 			c.disconnecting |= 2
-			c.delete("Output Buffer Exceeded")
+			c.delete(fmt.Sprintf("SendQ exceeded (%d bytes)", cap(c.outbuf)))
 			return false
 		}
 
@@ -113,7 +155,7 @@ func (c *Client) write(line []byte) bool {
 
 		// Try to write.
 		n, err := c.conn.Write(line)
-		if err != nil && err.(net.Error).Timeout() == false {
+		if e, ok := err.(net.Error); err != nil && !(ok && e.Timeout()) {
 			// Suppress output prior to calling delete, so it
 			// does not attempt to send a quit message.
 			c.disconnecting |= 2
@@ -140,11 +182,16 @@ func (c *Client) write(line []byte) bool {
 	return true
 }
 
-// Switch the client to buffered I/O. The caller of this becomes the output
-// goroutine and is responsible for ensuring that output happens.
+// Switch the client to buffered I/O, with a buffer of their class's sendq.
+// The caller of this becomes the output goroutine and is responsible for
+// ensuring that output happens.
 // Assumes the caller holds the client mutex.
 func (c *Client) bufferOn() {
-	c.outbuf = make([]byte, 0, 8192)
+	sendq := DefaultClass.SendQ
+	if c.class != nil && c.class.SendQ != 0 {
+		sendq = c.class.SendQ
+	}
+	c.outbuf = make([]byte, 0, sendq)
 	c.conn.SetWriteTimeout(0)
 }
 
@@ -185,23 +232,67 @@ func (c *Client) WriteBlock(f func() []byte) {
 // SendLineTo sends a formatted line to the client, from the given source user.
 // It wraps irc.SendLine.
 func (c *Client) SendLineTo(u *core.User, cmd string, format string, args ...interface{}) {
-	var from string
-	if u != nil {
-		from = u.Nick() + "!" + u.GetIdent() + "@" + u.GetHostname()
-	} else {
-		from = core.Global.Data("name")
-	}
-	irc.SendLine(c, from, c.u.Nick(), cmd, format, args...)
+	c.SendLineTags(nil, u, cmd, format, args...)
+}
+
+// SendLineTags sends a formatted line to the client, from the given source
+// user, with the given message tags. Tags the client has not enabled the
+// capabilities for are dropped. It wraps irc.SendLineTags.
+func (c *Client) SendLineTags(tags irc.Tags, u *core.User, cmd string, format string, args ...interface{}) {
+	irc.SendLineTags(c, c.tagsFor(tags, u), c.from(u), c.User().Nick(), cmd, format, args...)
 }
 
 // SendFrom sends a prewritten line to this client, from the given source user.
 // It wraps irc.SendFrom.
 func (c *Client) SendFrom(u *core.User, format string, args ...interface{}) {
-	var from string
+	c.SendFromTags(nil, u, format, args...)
+}
+
+// SendFromTags sends a prewritten line to this client, from the given source
+// user, with the given message tags. Tags the client has not enabled the
+// capabilities for are dropped. It wraps irc.SendFromTags.
+func (c *Client) SendFromTags(tags irc.Tags, u *core.User, format string, args ...interface{}) {
+	irc.SendFromTags(c, c.tagsFor(tags, u), c.from(u), format, args...)
+}
+
+// Returns the prefix for lines to this client from the given source user, or
+// from the server if nil.
+func (c *Client) from(u *core.User) string {
 	if u != nil {
-		from = u.Nick() + "!" + u.GetIdent() + "@" + u.GetHostname()
-	} else {
-		from = core.Global.Data("name")
+		return u.Nick() + "!" + u.GetIdent() + "@" + Hostname(c.User(), u)
+	}
+	return core.Global.Data("name")
+}
+
+// Hooks deciding the hostname of users shown to others.
+var hostHooks []func(viewer, u *core.User) string
+
+// AddHostHook adds a hook deciding the hostname of a user shown to a viewing
+// user, such as to hide it. The first hook returning a non-empty hostname
+// decides it; if none do, the user's real hostname is shown.
+// May only be used during init.
+func AddHostHook(h func(viewer, u *core.User) string) {
+	hostHooks = append(hostHooks, h)
+}
+
+// Hostname returns the hostname of the given user shown to the given viewing
+// user.
+func Hostname(viewer, u *core.User) string {
+	for _, h := range hostHooks {
+		if hostname := h(viewer, u); hostname != "" {
+			return hostname
+		}
+	}
+	return u.GetHostname()
+}
+
+// sendOthers sends a prewritten line from this client's user to every other
+// session attached to the user, so they see what this session sent.
+func (c *Client) sendOthers(format string, args ...interface{}) {
+	u := c.User()
+	for _, other := range GetClients(u) {
+		if other != c {
+			other.SendFrom(u, format, args...)
+		}
 	}
-	irc.SendFrom(c, from, format, args...)
 }
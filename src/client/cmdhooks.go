@@ -0,0 +1,105 @@
+package client
+
+import "os"
+import "strings"
+
+import "oddcomm/lib/irc"
+
+
+// Reasons a client command failed, passed to failed command hooks.
+const (
+	// The command was given too few parameters, or is not available
+	// before or after registration.
+	ParseFailed = iota
+
+	// The command does not exist.
+	NotFound
+
+	// The client lacks the oper flag the command requires.
+	PermissionDenied
+)
+
+// The error given to failed command hooks for commands denied to a client.
+var ErrPermissionDenied = os.NewError("You do not have the appropriate privileges to use this command.")
+
+
+// Command hooks, by the capitalised name of the command they are on, or "" for
+// hooks on all commands.
+var beforeHooks = make(map[string][]func(c *Client, command string, params [][]byte))
+var afterHooks = make(map[string][]func(c *Client, command string, params [][]byte))
+var failedHooks = make(map[string][]func(c *Client, command string, params [][]byte, reason int, err os.Error))
+
+
+// HookBefore adds a hook run prior to the given command, or all commands if
+// command is "", after it has been parsed and before its permissions are
+// checked. Hooks cannot prevent the command from running, or modify it.
+// May only be used during init.
+func HookBefore(command string, h func(c *Client, command string, params [][]byte)) {
+	command = strings.ToUpper(command)
+	beforeHooks[command] = append(beforeHooks[command], h)
+}
+
+// HookAfter adds a hook run after the given command, or all commands if
+// command is "", has run. Hooks cannot modify the command's effects.
+// May only be used during init.
+func HookAfter(command string, h func(c *Client, command string, params [][]byte)) {
+	command = strings.ToUpper(command)
+	afterHooks[command] = append(afterHooks[command], h)
+}
+
+// HookFailed adds a hook run when the given command, or any command if command
+// is "", fails, with the reason and the error the client was told of. If the
+// command failed to parse or was not found, params is empty, and command is
+// the name the client sent, capitalised.
+// May only be used during init.
+func HookFailed(command string, h func(c *Client, command string, params [][]byte, reason int, err os.Error)) {
+	command = strings.ToUpper(command)
+	failedHooks[command] = append(failedHooks[command], h)
+}
+
+
+// Runs the before hooks for a command.
+func runBefore(c *Client, command string, params [][]byte) {
+	for _, h := range beforeHooks[""] {
+		h(c, command, params)
+	}
+	for _, h := range beforeHooks[command] {
+		h(c, command, params)
+	}
+}
+
+// Runs the after hooks for a command.
+func runAfter(c *Client, command string, params [][]byte) {
+	for _, h := range afterHooks[""] {
+		h(c, command, params)
+	}
+	for _, h := range afterHooks[command] {
+		h(c, command, params)
+	}
+}
+
+// Runs the failed hooks for a command, picking the reason from the parse
+// error if there is one. The command is "" for lines which failed to parse
+// before their command was read, which run only the hooks for all commands.
+func runFailed(c *Client, command string, params [][]byte, perr *irc.ParseError) {
+	reason := PermissionDenied
+	var err os.Error = ErrPermissionDenied
+	if perr != nil {
+		reason = ParseFailed
+		if perr.Num == irc.CmdNotFound {
+			reason = NotFound
+		}
+		err = perr
+	}
+
+	command = strings.ToUpper(command)
+	for _, h := range failedHooks[""] {
+		h(c, command, params, reason, err)
+	}
+	if command == "" {
+		return
+	}
+	for _, h := range failedHooks[command] {
+		h(c, command, params, reason, err)
+	}
+}
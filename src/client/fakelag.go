@@ -0,0 +1,96 @@
+package client
+
+import "time"
+
+import "oddcomm/lib/irc"
+import "oddcomm/lib/perm"
+
+
+// The cost of commands which don't declare one, in milliseconds of penalty.
+var DefaultCost int64 = 1000
+
+// How much penalty, in milliseconds, a client may build up before their
+// commands are delayed, unless their class says otherwise. Penalty drains at
+// one millisecond per millisecond.
+var FloodBurst int64 = 10000
+
+// How much penalty, in milliseconds, a client may run up in commands which
+// each have to be delayed, one after another, before they are disconnected for
+// Excess Flood, unless their class says otherwise. A client sending faster
+// than their penalty drains keeps adding to it, however slowly. Zero for no
+// limit.
+var FloodMax int64 = 60000
+
+
+func init() {
+	// Opers with this flag are exempt from flood control.
+	perm.AddServerDefOpFlag("flood")
+}
+
+
+// Applies flood control to a client about to run the given command, or send
+// an unknown or invalid command if nil, delaying them if they've exceeded
+// their burst. Returns false if they have been disconnected for flooding, and
+// the command should be dropped. Must be called from the input goroutine.
+func (c *Client) fakelag(command *irc.Command) bool {
+	class := c.getClass()
+	if class.NoFlood || perm.HasOpFlag(c.User(), nil, "flood") {
+		return true
+	}
+	burst := FloodBurst
+	if class.FloodBurst != 0 {
+		burst = class.FloodBurst
+	}
+	max := FloodMax
+	if class.FloodMax != 0 {
+		max = class.FloodMax
+	}
+
+	cost := DefaultCost
+	if command != nil && command.Cost != 0 {
+		cost = command.Cost
+	}
+	if cost < 0 {
+		return true
+	}
+
+	now := time.Nanoseconds() / 1e6
+	c.mutex.Lock()
+	delay, ok := c.addPenalty(cost, burst, max, now)
+	if !ok {
+		c.delete("Excess Flood")
+		c.mutex.Unlock()
+		return false
+	}
+	c.mutex.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay * 1e6)
+	}
+
+	return true
+}
+
+// Drains a client's penalty for the time since their last command, then adds
+// the given cost, at the given time in milliseconds. Returns how long, in
+// milliseconds, to delay the command, and false if the client is flooding.
+// Must be called while holding the client mutex.
+func (c *Client) addPenalty(cost, burst, max, now int64) (delay int64, ok bool) {
+	c.penalty -= now - c.penaltyAt
+	if c.penalty < 0 {
+		c.penalty = 0
+	}
+	c.penaltyAt = now
+	c.penalty += cost
+
+	// Delaying them drains their penalty back to their burst, so count
+	// what they run up in commands delayed in a row instead.
+	delay = c.penalty - burst
+	if delay > 0 {
+		c.lagged += cost
+	} else {
+		c.lagged = 0
+	}
+
+	return delay, max == 0 || c.lagged <= max
+}
@@ -0,0 +1,69 @@
+package client
+
+import "testing"
+
+
+// Sends commands of the given cost from a new client, each the given number
+// of milliseconds after the last one finished being delayed, until they're
+// disconnected or have sent the given number. Returns how many were sent
+// before they were disconnected, or -1 if they never were.
+func flood(cost, interval int64, commands int) int {
+	c := new(Client)
+	var now int64 = 1e6
+	for i := 0; i < commands; i++ {
+		delay, ok := c.addPenalty(cost, FloodBurst, FloodMax, now)
+		if !ok {
+			return i
+		}
+		if delay > 0 {
+			now += delay
+		}
+		now += interval
+	}
+	return -1
+}
+
+func TestFloodDisconnected(t *testing.T) {
+
+	// Commands sent back to back are delayed down to the drain rate, but
+	// still flood.
+	if sent := flood(DefaultCost, 0, 1000); sent == -1 {
+		t.Errorf("back to back commands were never disconnected")
+	} else if limit := int((FloodBurst+FloodMax)/DefaultCost) + 1; sent > limit {
+		t.Errorf("back to back commands disconnected after %d, want at most %d", sent, limit)
+	}
+
+	// So do commands sent a little faster than the drain rate.
+	if sent := flood(DefaultCost, DefaultCost/2, 1000); sent == -1 {
+		t.Errorf("fast commands were never disconnected")
+	}
+
+	// Expensive commands flood sooner.
+	if cheap, dear := flood(DefaultCost, 0, 1000), flood(4*DefaultCost, 0, 1000); dear >= cheap {
+		t.Errorf("expensive commands disconnected after %d, cheap ones after %d", dear, cheap)
+	}
+}
+
+func TestFloodAllowed(t *testing.T) {
+
+	// Commands sent no faster than the drain rate are never delayed.
+	if sent := flood(DefaultCost, DefaultCost, 1000); sent != -1 {
+		t.Errorf("commands at the drain rate disconnected after %d", sent)
+	}
+
+	// A burst followed by a pause is delayed, but not disconnected.
+	c := new(Client)
+	var now int64 = 1e6
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 20; i++ {
+			delay, ok := c.addPenalty(DefaultCost, FloodBurst, FloodMax, now)
+			if !ok {
+				t.Fatalf("burst disconnected in round %d, after %d commands", round, i)
+			}
+			if delay > 0 {
+				now += delay
+			}
+		}
+		now += 60000
+	}
+}
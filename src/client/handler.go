@@ -1,5 +1,7 @@
 package client
 
+import "crypto/tls"
+import "fmt"
 import "os"
 
 import "oddcomm/lib/irc"
@@ -24,40 +26,106 @@ func input(c *Client) {
 		c.mutex.Unlock()
 	}()
 
+	// If they're connecting through a proxy, find out where from.
+	if fromProxy(c) {
+		if err := readProxy(c); err != nil {
+			errMsg = "Invalid PROXY Header"
+			return
+		}
+	}
+
+	// If this is a TLS listener, complete the handshake.
+	if c.listener != nil && c.listener.TLS {
+		conn := tls.Server(c.conn, getTLSConfig())
+		c.mutex.Lock()
+		c.conn = conn
+		c.mutex.Unlock()
+
+		if !handshake(c, conn) {
+			errMsg = "TLS Handshake Failed"
+			return
+		}
+	}
+
+	// If this is a WebSocket listener, complete the handshake.
+	if c.listener != nil && c.listener.WebSocket {
+		conn, err := wsHandshake(c.conn)
+		if err != nil {
+			errMsg = "WebSocket Handshake Failed"
+			return
+		}
+		c.mutex.Lock()
+		c.conn = conn
+		c.mutex.Unlock()
+	}
 
-	irc.ReadLine(c.conn, make([]byte, 2096), func(line []byte) {
-		// Parse the line, ignoring any specified origin.
-		_, command, params, perr := irc.Parse(Commands, line,
-			c.u.Registered())
+	// Now we know where they're connecting from, place them in their
+	// class, checking its limits.
+	if !setClass(c) {
+		return
+	}
+
+	// Look up their hostname and ident while they register, and start
+	// checking they're still there.
+	go lookup(c)
+	go pinger(c)
+	go regTimeout(c)
+
+	// Read ahead no more than their class's recvq, which may change as
+	// they register.
+	recvq := func() int { return c.recvQ() }
+	errMsg = irc.ReadLineLimit(c.conn, make([]byte, maxRecvQ()), recvq, func(line []byte) {
+		c.active()
+
+		// Parse the line, ignoring any specified origin. Clients may
+		// send less tag data than servers.
+		u := c.User()
+		tags, _, command, params, perr := irc.ParseTaggedLimit(Commands,
+			line, u.Registered(), irc.MaxClientTagData)
+		c.tags = tags
+
+		// Delay them if they're sending commands too fast.
+		if !c.fakelag(command) {
+			return
+		}
 
 		// If we successfully got a command, run it.
 		if command != nil {
+			runBefore(c, command.Name, params)
 
 			// If it's an oper command, check permissions.
-			if command.OperFlag != "" && !perm.HasOperCommand(c.u, command.OperFlag, command.Name) {
-				c.SendLineTo(nil, "481", ":You do not have the appropriate privileges to use this command.")
+			if command.OperFlag != "" && !perm.HasOperCommand(u, command.OperFlag, command.Name) {
+				c.SendLineTo(nil, "481", ":%s", ErrPermissionDenied)
+				runFailed(c, command.Name, params, nil)
 				return
 			}
 			command.Handler(c, params)
+			runAfter(c, command.Name, params)
 		} else if perr != nil {
+			runFailed(c, perr.CmdName, params, perr)
 
 			// The IRC protocol is stupid.
 			switch perr.Num {
 			case irc.CmdNotFound:
-				if c.u.Registered() {
+				if u.Registered() {
 					c.SendLineTo(nil, "421", "%s :%s",
 						perr.CmdName, perr)
 				}
 			case irc.CmdForRegistered:
 				c.SendFrom(nil, "451 %s :%s", perr.CmdName, perr)
+			case irc.TagsTooLong:
+				c.SendLineTo(nil, "417", ":%s", perr)
 			case irc.CmdForUnregistered:
-				c.SendFrom(nil, "462 %s :%s", c.u.Nick(), perr)
+				c.SendFrom(nil, "462 %s :%s", u.Nick(), perr)
 			default:
-				c.SendFrom(nil, "461 %s %s :%s", c.u.Nick(),
+				c.SendFrom(nil, "461 %s %s :%s", u.Nick(),
 					perr.CmdName, perr)
 			}
 		}
 	})
+	if errMsg == "Input Buffer Exceeded" {
+		errMsg = fmt.Sprintf("RecvQ exceeded (%d bytes)", c.recvQ())
+	}
 }
 
 
@@ -3,6 +3,9 @@ package client
 import "fmt"
 
 import "oddcomm/src/core"
+import "oddcomm/src/offline"
+import "oddcomm/lib/filter"
+import "oddcomm/lib/irc"
 
 
 func init() {
@@ -12,28 +15,28 @@ func init() {
 		// Send the nick change to every user on a common channel.
 		for ch := u.Channels(); ch != nil; ch = ch.UserNext() {
 			for m := ch.Channel().Users(); m != nil; m = m.ChanNext() {
-				chu := m.User()
+				for _, c := range GetClients(m.User()) {
+					if sent[c] {
+						continue
+					}
 
-				c := GetClient(chu)
-				if c == nil || sent[c] {
-					continue
-				}
-
-				fmt.Fprintf(c, ":%s!%s@%s NICK %s\r\n", oldnick,
-					u.Data("ident"), u.Data("hostname"),
-					u.Nick())
+					fmt.Fprintf(c, ":%s!%s@%s NICK %s\r\n",
+						oldnick, u.Data("ident"),
+						Hostname(m.User(), u), u.Nick())
 
-				sent[c] = true
+					sent[c] = true
+				}
 			}
 		}
 
-		c := GetClient(u)
-		if c == nil || sent[c] {
-			return
-		}
+		for _, c := range GetClients(u) {
+			if sent[c] {
+				continue
+			}
 
-		fmt.Fprintf(c, ":%s!%s@%s NICK %s\r\n", oldnick,
-			u.Data("ident"), u.Data("hostname"), u.Nick())
+			fmt.Fprintf(c, ":%s!%s@%s NICK %s\r\n", oldnick,
+				u.Data("ident"), Hostname(u, u), u.Nick())
+		}
 	},
 		false)
 
@@ -44,66 +47,52 @@ func init() {
 		}
 
 		if oldvalue == "" {
-			target.PermitRegistration(me)
+			if c := GetClient(target); c != nil {
+				register(c)
+			} else {
+				target.PermitRegistration(me)
+			}
 		}
 	},
 		true)
 
 	core.HookUserDataChanges(func(_ interface{}, source, target *core.User, c []core.DataChange, old []string) {
-		cli := GetClient(target)
-		if cli == nil {
+		modeline := UserModes.ParseChanges(target, c, old)
+		if modeline == "" {
 			return
 		}
-
-		modeline := UserModes.ParseChanges(target, c, old)
-		if modeline != "" {
+		for _, cli := range GetClients(target) {
 			cli.SendLineTo(source, "MODE", modeline)
 		}
 	},
 		false)
 
-	core.HookUserRegister(func(_ interface{}, u *core.User) {
-		c := GetClient(u)
-		if c == nil {
-			return
-		}
-
-		c.SendLineTo(nil, "001", ":Welcome to the %s IRC Network %s!%s@%s", "Testnet", u.Nick(), u.GetIdent(), u.GetHostname())
-		c.SendLineTo(nil, "002", "Your host is %s, running version OddComm-%s", core.Global.Data("name"), core.Version)
-		c.SendLineTo(nil, "004", "%s OddComm-%s %s%s%s %s %s%s%s", core.Global.Data("name"), core.Version, UserModes.AllSimple(), UserModes.AllParametered(), UserModes.AllList(), ChanModes.AllSimple(), ChanModes.AllParametered(), ChanModes.AllList(), ChanModes.AllMembership())
-		c.SendLineTo(nil, "005", "%s :are supported by this server", supportLine)
-		c.SendLineTo(nil, "005", "%s :your unique ID", u.ID())
-		modeline := UserModes.GetModes(u)
-		c.SendLineTo(u, "MODE", "+%s", modeline)
-	})
-
 	core.HookUserMessage("", func(_ interface{}, source, target *core.User, message []byte) {
-		c := GetClient(target)
-		if c == nil {
+		message, err := filter.UserMsgTo(source, target, message, "")
+		if err != nil {
 			return
 		}
-
-		c.SendLineTo(source, "PRIVMSG", ":%s", message)
+		for _, c := range GetClients(target) {
+			c.SendLineTo(source, "PRIVMSG", ":%s", message)
+		}
 	})
 
 	core.HookUserMessage("noreply",
 		func(_ interface{}, source, target *core.User, message []byte) {
-			c := GetClient(target)
-			if c == nil {
+			message, err := filter.UserMsgTo(source, target, message, "noreply")
+			if err != nil {
 				return
 			}
-
-			c.SendLineTo(source, "NOTICE", ":%s", message)
+			for _, c := range GetClients(target) {
+				c.SendLineTo(source, "NOTICE", ":%s", message)
+			}
 		})
 
 	core.HookUserMessage("invite",
 		func(_ interface{}, source, target *core.User, message []byte) {
-			c := GetClient(target)
-			if c == nil {
-				return
+			for _, c := range GetClients(target) {
+				c.SendLineTo(source, "INVITE", ":#%s", message)
 			}
-
-			c.SendLineTo(source, "INVITE", ":#%s", message)
 		})
 
 	core.HookChanUserJoin("", func(origin interface{}, ch *core.Channel, users []*core.User) {
@@ -112,16 +101,13 @@ func init() {
 		// Send the JOINs to all clients in the same channel.
 		for m := ch.Users(); m != nil; m = m.ChanNext() {
 			chu := m.User()
-			c := GetClient(chu)
-			if c == nil {
-				continue
-			}
-
-			for _, u := range users {
-				if chu == u && pkg == me {
-					continue
+			for _, c := range GetClients(chu) {
+				for _, u := range users {
+					if chu == u && pkg == me {
+						continue
+					}
+					c.SendFrom(u, "JOIN #%s", ch.Name())
 				}
-				c.SendFrom(u, "JOIN #%s", ch.Name())
 			}
 		}
 
@@ -133,35 +119,17 @@ func init() {
 		// Otherwise, if this is one of our clients,
 		// we need to send them info.
 		for _, u := range users {
-			c := GetClient(u)
-			if c == nil {
-				continue
+			for _, c := range GetClients(u) {
+				sendJoinInfo(c, ch)
 			}
-
-			// Done concurrently, since sending NAMES can block.
-			go func() {
-				// Send them NAMES.
-				cmdNames(c, [][]byte{[]byte(ch.Name())})
-
-				// Send them the topic.
-				if topic, setby, setat := ch.GetTopic(); topic != "" {
-					c.SendLineTo(nil, "332", "#%s :%s", ch.Name(),
-						topic)
-					c.SendLineTo(nil, "333", "#%s %s %s",
-						ch.Name(), setby, setat)
-				}
-			}()
 		}
 	})
 
 	core.HookChanDataChange("", "topic", func(_ interface{}, source *core.User, ch *core.Channel, _, newvalue string) {
 		for m := ch.Users(); m != nil; m = m.ChanNext() {
-			c := GetClient(m.User())
-			if c == nil {
-				continue
+			for _, c := range GetClients(m.User()) {
+				c.SendFrom(source, "TOPIC #%s :%s", ch.Name(), newvalue)
 			}
-
-			c.SendFrom(source, "TOPIC #%s :%s", ch.Name(), newvalue)
 		}
 	})
 
@@ -171,11 +139,9 @@ func init() {
 			return
 		}
 		for m := ch.Users(); m != nil; m = m.ChanNext() {
-			c := GetClient(m.User())
-			if c == nil {
-				continue
+			for _, c := range GetClients(m.User()) {
+				c.SendFrom(source, "MODE #%s %s", ch.Name(), modeline)
 			}
-			c.SendFrom(source, "MODE #%s %s", ch.Name(), modeline)
 		}
 	})
 
@@ -187,10 +153,10 @@ func init() {
 		}
 
 		// Send a PART or KICK to the user themselves.
-		if c := GetClient(u); c != nil {
+		for _, c := range GetClients(u) {
 			if source == u {
 				c.SendFrom(u, "PART #%s :%s", ch.Name(),
-					message)
+					partReason(u, ch, u, message))
 			} else {
 				c.SendFrom(source, "KICK #%s %s :%s",
 					ch.Name(), u.Nick(), message)
@@ -199,10 +165,10 @@ func init() {
 
 		// Send a PART or KICK to everyone in the user's channel.
 		for m := ch.Users(); m != nil; m = m.ChanNext() {
-			if c := GetClient(m.User()); c != nil {
+			for _, c := range GetClients(m.User()) {
 				if source == u {
 					c.SendFrom(u, "PART #%s :%s",
-						ch.Name(), message)
+						ch.Name(), partReason(u, ch, m.User(), message))
 				} else {
 					c.SendFrom(source, "KICK #%s %s :%s",
 						ch.Name(), u.Nick(),
@@ -217,9 +183,13 @@ func init() {
 			if m.User() == source {
 				continue
 			}
-			if c := GetClient(m.User()); c != nil {
+			filtered, err := filter.ChanMsgTo(source, ch, m.User(), message, "")
+			if err != nil {
+				continue
+			}
+			for _, c := range GetClients(m.User()) {
 				c.SendFrom(source, "PRIVMSG #%s :%s",
-					ch.Name(), message)
+					ch.Name(), filtered)
 			}
 		}
 	})
@@ -229,16 +199,20 @@ func init() {
 			if m.User() == source {
 				continue
 			}
-			if c := GetClient(m.User()); c != nil {
+			filtered, err := filter.ChanMsgTo(source, ch, m.User(), message, "noreply")
+			if err != nil {
+				continue
+			}
+			for _, c := range GetClients(m.User()) {
 				c.SendFrom(source, "NOTICE #%s :%s",
-					ch.Name(), message)
+					ch.Name(), filtered)
 			}
 		}
 	})
 
 	core.HookChanMessage("", "invite", func(_ interface{}, source *core.User, ch *core.Channel, message []byte) {
 		for m := ch.Users(); m != nil; m = m.ChanNext() {
-			if c := GetClient(m.User()); c != nil {
+			for _, c := range GetClients(m.User()) {
 				c.SendFrom(nil, "NOTICE #%s :*** INVITE: %s invited %s into the channel.", ch.Name(), source.Nick(), message)
 			}
 		}
@@ -249,21 +223,22 @@ func init() {
 
 		// Send a KILL message to the user, if they were deleted by
 		/// another user and are our client.
-		if c := GetClient(u); c != nil {
+		for _, c := range GetClients(u) {
 			if source != nil && source != u {
 				c.SendLineTo(source, "KILL", "%s (%s)", source.Nick(), message)
 			}
 		}
 
 		// Add text to the message to indicate its source.
+		reason := message
 		if source == u {
 			message = "Quit: " + message
 		} else if source != nil {
 			message = "Killed by " + source.Nick() + ": " + message
 		}
 
-		// If this is our client, delete them.
-		if c := GetClient(u); c != nil {
+		// If this is our client, delete every session.
+		for _, c := range GetClients(u) {
 			c.mutex.Lock()
 			c.delete(message)
 			c.mutex.Unlock()
@@ -273,14 +248,89 @@ func init() {
 		// Send the quit to every user on every channel the user is on.
 		for ch := u.Channels(); ch != nil; ch = ch.UserNext() {
 			for m := ch.Channel().Users(); m != nil; m = m.ChanNext() {
-				c := GetClient(m.User())
-				if c == nil || sent[c] {
-					continue
+				for _, c := range GetClients(m.User()) {
+					if sent[c] {
+						continue
+					}
+					if source == u {
+						c.SendFrom(u, "QUIT :Quit: %s", quitReason(u, m.User(), reason))
+					} else {
+						c.SendFrom(u, "QUIT :%s", message)
+					}
+					sent[c] = true
 				}
-				c.SendFrom(u, "QUIT :%s", message)
-				sent[c] = true
 			}
 		}
 	},
 		true)
 }
+
+// Returns a user's part reason as shown to the recipient, or "" if filters
+// hide it from them.
+func partReason(u *core.User, ch *core.Channel, recipient *core.User, message string) string {
+	reason, err := filter.PartTo(u, ch, recipient, []byte(message))
+	if err != nil {
+		return ""
+	}
+	return string(reason)
+}
+
+// Returns a user's quit reason as shown to the recipient, or "" if filters
+// hide it from them.
+func quitReason(u, recipient *core.User, message string) string {
+	reason, err := filter.QuitTo(u, recipient, []byte(message))
+	if err != nil {
+		return ""
+	}
+	return string(reason)
+}
+
+// Sends a client the welcome burst on registration or attaching to a user.
+func welcome(c *Client) {
+	u := c.User()
+	c.SendLineTo(nil, "001", ":Welcome to the %s IRC Network %s!%s@%s", "Testnet", u.Nick(), u.GetIdent(), Hostname(u, u))
+	c.SendLineTo(nil, "002", "Your host is %s, running version OddComm-%s", core.Global.Data("name"), core.Version)
+	c.SendLineTo(nil, "004", "%s OddComm-%s %s%s%s %s %s%s%s", core.Global.Data("name"), core.Version, UserModes.AllSimple(), UserModes.AllParametered(), UserModes.AllList(), ChanModes.AllSimple(), ChanModes.AllParametered(), ChanModes.AllList(), ChanModes.AllMembership())
+	c.SendLineTo(nil, "005", "%s :are supported by this server", supportLine)
+	c.SendLineTo(nil, "005", "%s :your unique ID", u.ID())
+	modeline := UserModes.GetModes(u)
+	c.SendLineTo(u, "MODE", "+%s", modeline)
+}
+
+// Sends a client any messages stored for their account while they were
+// offline.
+func sendOffline(c *Client) {
+	u := c.User()
+	account := u.Data("account")
+	if account == "" {
+		return
+	}
+
+	stored := offline.Take(account)
+	if len(stored) != 0 {
+		c.SendLineTo(nil, "NOTICE", ":*** You have %d message(s) sent while you were offline.", len(stored))
+	}
+	for _, m := range stored {
+		cmd := "PRIVMSG"
+		if m.Type == "noreply" {
+			cmd = "NOTICE"
+		}
+		irc.SendLine(c, m.Source, u.Nick(), cmd, ":%s", m.Message)
+	}
+}
+
+// Sends a client NAMES and the topic for a channel their user joined.
+// Done concurrently, since sending NAMES can block.
+func sendJoinInfo(c *Client, ch *core.Channel) {
+	go func() {
+		// Send them NAMES.
+		cmdNames(c, [][]byte{[]byte(ch.Name())})
+
+		// Send them the topic.
+		if topic, setby, setat := ch.GetTopic(); topic != "" {
+			c.SendLineTo(nil, "332", "#%s :%s", ch.Name(), topic)
+			c.SendLineTo(nil, "333", "#%s %s %s", ch.Name(), setby,
+				setat)
+		}
+	}()
+}
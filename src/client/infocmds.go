@@ -39,6 +39,7 @@ func init() {
 	c.Handler = cmdWho
 	c.Minargs = 1
 	c.Maxargs = 1
+	c.Cost = 4000
 	Commands.Add(c)
 
 	c = new(irc.Command)
@@ -46,6 +47,7 @@ func init() {
 	c.Handler = cmdNames
 	c.Minargs = 1
 	c.Maxargs = 1
+	c.Cost = 2000
 	Commands.Add(c)
 
 	c = new(irc.Command)
@@ -104,7 +106,7 @@ func cmdUserhost(source interface{}, params [][]byte) {
 		} else {
 			replyline += "+"
 		}
-		replyline += user.GetHostname()
+		replyline += Hostname(c.u, user)
 	}
 
 	c.SendLineTo(nil, "302", ":%s", replyline)
@@ -171,7 +173,7 @@ func cmdWho(source interface{}, params [][]byte) {
 		servername := core.Global.Data("name")
 		result := fmt.Sprintf(":%s 352 %s #%s %s %s %s %s %s :0 %s\r\n",
 			servername, c.u.Nick(), channame, user.GetIdent(),
-			user.GetHostname(), servername, user.Nick(),
+			Hostname(c.u, user), servername, user.Nick(),
 			prefixes, user.Data("realname"))
 
 		it = it.ChanNext()
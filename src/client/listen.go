@@ -0,0 +1,230 @@
+package client
+
+import "fmt"
+import "net"
+import "os"
+import "strings"
+import "sync"
+import "time"
+
+import "oddcomm/src/core"
+
+
+// Listener describes an address clients may connect to, and settings for
+// clients connecting to it.
+type Listener struct {
+	// The network to listen on; "tcp", "tcp4", "tcp6", or "unix".
+	Network string
+
+	// The address to listen on; a host and port for TCP, such as
+	// "127.0.0.1:6667" or "[::1]:6667", or a path for UNIX sockets.
+	Address string
+
+	// Whether connections use TLS.
+	TLS bool
+
+	// Whether connections use WebSocket, after any TLS.
+	WebSocket bool
+
+	// The connection class clients connecting here are placed in.
+	// Empty for the default class.
+	Class string
+
+	// Whether clients connecting here may use WEBIRC.
+	WebIRC bool
+
+	// Whether connections from proxies send a PROXY protocol header, and
+	// masks or CIDR ranges matching the IPs of proxies to accept it from. Connections from
+	// elsewhere are treated as direct connections from clients.
+	Proxy     bool
+	ProxyFrom []string
+}
+
+// Listeners to start with the subsystem. May only be changed before starting
+// the subsystem; use AddListener and RemoveListener afterwards.
+var Listen = []*Listener{
+	&Listener{Network: "tcp", Address: "127.0.0.1:6667"},
+	&Listener{Network: "tcp", Address: "127.0.0.1:6697", TLS: true},
+}
+
+// A listener which is running.
+type listener struct {
+	config  *Listener
+	l       net.Listener
+	removed bool
+}
+
+// Maps "<network> <address>" to running listeners.
+var listeners = make(map[string]*listener)
+var listenMutex sync.Mutex
+
+
+// AddListener starts listening for clients as described. Changing the
+// Listener after adding it has no effect.
+func AddListener(config *Listener) os.Error {
+	copied := new(Listener)
+	*copied = *config
+	copied.ProxyFrom = make([]string, len(config.ProxyFrom))
+	copy(copied.ProxyFrom, config.ProxyFrom)
+	config = copied
+
+	if config.TLS && getTLSConfig() == nil {
+		return os.NewError("No TLS certificate loaded.")
+	}
+
+	key := config.Network + " " + config.Address
+
+	listenMutex.Lock()
+	defer listenMutex.Unlock()
+
+	if listeners[key] != nil {
+		return os.NewError("Already listening on " + key + ".")
+	}
+
+	l, err := net.Listen(config.Network, config.Address)
+	if err != nil {
+		return err
+	}
+
+	running := new(listener)
+	running.config = config
+	running.l = l
+	listeners[key] = running
+
+	go listen(running)
+
+	return nil
+}
+
+// RemoveListener stops listening for clients on the given network and
+// address. Clients which connected to it are unaffected.
+func RemoveListener(network, address string) os.Error {
+	key := network + " " + address
+
+	listenMutex.Lock()
+	running := listeners[key]
+	if running != nil {
+		running.removed = true
+		listeners[key] = nil, false
+	}
+	listenMutex.Unlock()
+
+	if running == nil {
+		return os.NewError("Not listening on " + key + ".")
+	}
+
+	return running.l.Close()
+}
+
+// Listeners returns descriptions of every address we're listening on.
+func Listeners() []*Listener {
+	listenMutex.Lock()
+	defer listenMutex.Unlock()
+
+	list := make([]*Listener, 0, len(listeners))
+	for _, running := range listeners {
+		config := new(Listener)
+		*config = *running.config
+		list = append(list, config)
+	}
+
+	return list
+}
+
+
+// Listen goroutine function, handling listening for one socket.
+// Owns its socket.
+func listen(running *listener) {
+	for {
+		c, err := running.l.Accept()
+		if err != nil {
+			// Wait out temporary errors, such as running out of
+			// file descriptors.
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				fmt.Printf("Error accepting on %s %s: %s\n", running.config.Network, running.config.Address, err)
+				time.Sleep(1e9)
+				continue
+			}
+
+			listenMutex.Lock()
+			removed := running.removed
+			if !removed {
+				key := running.config.Network + " " + running.config.Address
+				listeners[key] = nil, false
+			}
+			remaining := len(listeners)
+			listenMutex.Unlock()
+
+			if !removed {
+				fmt.Printf("Stopped listening on %s %s: %s\n", running.config.Network, running.config.Address, err)
+				running.l.Close()
+
+				// If that was our last listener, nobody can
+				// connect; shut down.
+				if remaining == 0 {
+					fmt.Printf("No listeners remain, terminating.\n")
+					core.Shutdown()
+				}
+			}
+			return
+		}
+
+		client := new(Client)
+		client.outchan = make(chan bool, 1)
+		client.done = make(chan bool)
+		client.listener = running.config
+		client.conn = c
+		client.conn.SetWriteTimeout(1000)
+
+		data := make([]core.DataChange, 2)
+		data[0].Name, data[0].Data = "ip", remoteIP(c)
+		data[1].Name, data[1].Data = "hostname", data[0].Data
+
+		s := new(sessions)
+		s.clients = []*Client{client}
+		client.u = core.NewUser(me, s, false, "", data)
+		incClient(client)
+
+		go input(client)
+	}
+}
+
+// Returns the IP address of the remote end of a connection, as user data.
+func remoteIP(c net.Conn) string {
+	addr, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		// UNIX socket connections are local.
+		return "127.0.0.1"
+	}
+
+	return ipData(addr.IP)
+}
+
+// Returns the given IP address as user data.
+func ipData(ip net.IP) string {
+
+	// Addresses may not start with a colon, or they'd be taken for the
+	// start of the last parameter.
+	s := ip.String()
+	if strings.HasPrefix(s, ":") {
+		s = "0" + s
+	}
+
+	return s
+}
+
+// Stops every listener. Used when shutting down.
+func closeListeners() {
+	listenMutex.Lock()
+	var list []*listener
+	for key, running := range listeners {
+		running.removed = true
+		listeners[key] = nil, false
+		list = append(list, running)
+	}
+	listenMutex.Unlock()
+
+	for _, running := range list {
+		running.l.Close()
+	}
+}
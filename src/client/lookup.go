@@ -0,0 +1,229 @@
+package client
+
+import "bufio"
+import "fmt"
+import "net"
+import "os"
+import "strings"
+import "time"
+
+import "oddcomm/src/core"
+
+
+// Resolver performs the DNS lookups used to find clients' hostnames.
+type Resolver interface {
+	// LookupAddr returns the names the given address reverse resolves to.
+	LookupAddr(addr string) (names []string, err os.Error)
+
+	// LookupHost returns the addresses the given name resolves to.
+	LookupHost(host string) (addrs []string, err os.Error)
+}
+
+// The resolver used to look up clients' hostnames. Replaceable, such as with
+// one querying a local test server, before starting the subsystem.
+var DNS Resolver = netResolver{}
+
+// How long, in seconds, we wait for hostname and ident lookups before letting
+// the client register without them.
+var LookupTimeout int64 = 10
+
+// Whether to query clients' ident servers.
+var IdentLookups bool = true
+
+// The longest ident we use, including the "~" marking idents given by the
+// client rather than their ident server.
+var IdentLen = 10
+
+// The package name we hold registration under until lookups are done.
+var lookupHold string = "client/lookup"
+
+
+// Resolves using the system resolver.
+type netResolver struct{}
+
+func (netResolver) LookupAddr(addr string) ([]string, os.Error) {
+	return net.LookupAddr(addr)
+}
+
+func (netResolver) LookupHost(host string) ([]string, os.Error) {
+	return net.LookupHost(host)
+}
+
+
+func init() {
+	core.RegistrationHold(lookupHold)
+}
+
+
+// Looks up a client's hostname and ident, and sets them, then permits their
+// registration. Gives up on whichever lookups are unfinished after
+// LookupTimeout. Results are discarded if their IP changes meanwhile, as with
+// WEBIRC, or if the client attaches to another user. Run in its own goroutine
+// once a client has connected.
+func lookup(c *Client) {
+	u := c.User()
+	defer u.PermitRegistration(lookupHold)
+
+	ip := u.Data("ip")
+	pending := 1
+	hostc := make(chan string, 1)
+	identc := make(chan string, 1)
+
+	c.SendFrom(nil, "NOTICE * :*** Looking up your hostname...")
+	go func() { hostc <- resolve(ip) }()
+
+	// Only direct TCP connections can be asked about.
+	local, lok := c.conn.LocalAddr().(*net.TCPAddr)
+	remote, rok := c.conn.RemoteAddr().(*net.TCPAddr)
+	if IdentLookups && lok && rok && !fromProxy(c) {
+		pending++
+		c.SendFrom(nil, "NOTICE * :*** Checking ident...")
+		go func() { identc <- queryIdent(local, remote) }()
+	}
+
+	timeout := time.After(LookupTimeout * 1e9)
+	for pending > 0 {
+		select {
+		case hostname := <-hostc:
+			pending--
+			if c.User() != u || u.Data("ip") != ip {
+				continue
+			}
+			if hostname == "" {
+				c.SendFrom(nil, "NOTICE * :*** Couldn't look up your hostname, using your IP address instead.")
+				continue
+			}
+			c.SendFrom(nil, "NOTICE * :*** Found your hostname.")
+			u.SetData(nil, nil, "hostname", hostname)
+
+		case ident := <-identc:
+			pending--
+			if c.User() != u || u.Data("ip") != ip {
+				continue
+			}
+			if ident == "" {
+				c.SendFrom(nil, "NOTICE * :*** No ident response.")
+				continue
+			}
+			c.SendFrom(nil, "NOTICE * :*** Got ident response.")
+			setIdent(c, u, ident)
+
+		case <-timeout:
+			c.SendFrom(nil, "NOTICE * :*** Lookups timed out.")
+			return
+		}
+	}
+}
+
+// Returns the hostname the given IP reverse resolves to, if it resolves back
+// to the IP, or "" if there is no such hostname.
+func resolve(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+
+	names, err := DNS.LookupAddr(addr.String())
+	if err != nil || len(names) == 0 {
+		return ""
+	}
+	hostname := strings.TrimRight(names[0], ".")
+
+	// Hostnames containing these, or too long for clients, can't be used.
+	if hostname == "" || hostname[0] == ':' || len(hostname) > 63 ||
+		strings.IndexAny(hostname, " @!*?,") != -1 {
+		return ""
+	}
+
+	// Check the hostname resolves back to the same address, so its
+	// owner can't claim any name they like.
+	addrs, err := DNS.LookupHost(hostname)
+	if err != nil {
+		return ""
+	}
+	for _, a := range addrs {
+		if forward := net.ParseIP(a); forward != nil && forward.Equal(addr) {
+			return hostname
+		}
+	}
+
+	return ""
+}
+
+// Queries the ident server of the client connected with the given
+// addresses, per RFC 1413, returning their username or "" if there is none.
+func queryIdent(local, remote *net.TCPAddr) string {
+	laddr := new(net.TCPAddr)
+	laddr.IP = local.IP
+	raddr := new(net.TCPAddr)
+	raddr.IP = remote.IP
+	raddr.Port = 113
+
+	conn, err := net.DialTCP("tcp", laddr, raddr)
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	conn.SetTimeout(LookupTimeout * 1e9)
+
+	fmt.Fprintf(conn, "%d , %d\r\n", remote.Port, local.Port)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return ""
+	}
+
+	return parseIdent(line)
+}
+
+// Returns the username given in an ident server's reply, or "" if there is
+// none we can use.
+func parseIdent(line string) string {
+
+	// <port> , <port> : USERID : <os> : <username>
+	fields := strings.Split(line, ":", 4)
+	if len(fields) != 4 || strings.TrimSpace(fields[1]) != "USERID" {
+		return ""
+	}
+	ident := strings.TrimSpace(fields[3])
+
+	// Usernames we can't use, or which look like they weren't looked up,
+	// are ignored.
+	if ident == "" || ident[0] == '~' ||
+		strings.IndexAny(ident, " @!:") != -1 {
+		return ""
+	}
+	if len(ident) > IdentLen {
+		ident = ident[:IdentLen]
+	}
+
+	return ident
+}
+
+// Returns the ident to use for a client which gave the given username, until
+// their ident server confirms one; marked unverified with "~", and truncated
+// to IdentLen.
+func unverifiedIdent(username string) string {
+	ident := "~" + username
+	if len(ident) > IdentLen {
+		ident = ident[:IdentLen]
+	}
+	return ident
+}
+
+// Sets a client's ident to the looked up one, whether or not they've sent
+// USER yet, unless the client is no longer on the given user.
+func setIdent(c *Client, u *core.User, ident string) {
+	c.mutex.Lock()
+	if c.u != u {
+		c.mutex.Unlock()
+		return
+	}
+	c.ident = ident
+	c.mutex.Unlock()
+
+	// If they've sent USER, replace the ident they gave.
+	// Otherwise, USER will use this one.
+	if u.Data("ident") != "" {
+		u.SetData(nil, nil, "ident", ident)
+	}
+}
@@ -0,0 +1,109 @@
+package client
+
+import "os"
+import "testing"
+
+
+// A resolver answering from fixed tables, standing in for a DNS server.
+type fakeResolver struct {
+	reverse map[string][]string
+	forward map[string][]string
+}
+
+func (r *fakeResolver) LookupAddr(addr string) ([]string, os.Error) {
+	names, ok := r.reverse[addr]
+	if !ok {
+		return nil, os.NewError("no such address")
+	}
+	return names, nil
+}
+
+func (r *fakeResolver) LookupHost(host string) ([]string, os.Error) {
+	addrs, ok := r.forward[host]
+	if !ok {
+		return nil, os.NewError("no such host")
+	}
+	return addrs, nil
+}
+
+
+// Replaces the resolver for the duration of a test.
+func withResolver(r Resolver, f func()) {
+	old := DNS
+	DNS = r
+	defer func() { DNS = old }()
+	f()
+}
+
+func TestResolve(t *testing.T) {
+	r := new(fakeResolver)
+	r.reverse = map[string][]string{
+		"192.0.2.1":   []string{"good.example.com."},
+		"192.0.2.2":   []string{"liar.example.com."},
+		"192.0.2.3":   []string{"bad*name.example.com."},
+		"192.0.2.4":   []string{"dangling.example.com."},
+		"2001:db8::1": []string{"six.example.com."},
+		"192.0.2.5":   []string{},
+	}
+	r.forward = map[string][]string{
+		"good.example.com": []string{"192.0.2.9", "192.0.2.1"},
+		"liar.example.com": []string{"192.0.2.9"},
+		"six.example.com":  []string{"2001:db8::1"},
+	}
+
+	tests := []struct {
+		ip, hostname string
+	}{
+		{"192.0.2.1", "good.example.com"},
+		{"192.0.2.2", ""},
+		{"192.0.2.3", ""},
+		{"192.0.2.4", ""},
+		{"192.0.2.5", ""},
+		{"192.0.2.6", ""},
+		{"2001:db8::1", "six.example.com"},
+		{"not an ip", ""},
+	}
+
+	withResolver(r, func() {
+		for _, test := range tests {
+			if hostname := resolve(test.ip); hostname != test.hostname {
+				t.Errorf("resolve(%q) = %q, want %q", test.ip, hostname, test.hostname)
+			}
+		}
+	})
+}
+
+func TestParseIdent(t *testing.T) {
+	tests := []struct {
+		line, ident string
+	}{
+		{"6193, 23 : USERID : UNIX : stjohns\r\n", "stjohns"},
+		{"6195, 23 : ERROR : NO-USER\r\n", ""},
+		{"6193, 23 : USERID : UNIX : ~tilde\r\n", ""},
+		{"6193, 23 : USERID : UNIX : has space\r\n", ""},
+		{"6193, 23 : USERID : UNIX : \r\n", ""},
+		{"6193, 23 : USERID : UNIX : averyveryverylongname\r\n", "averyveryv"},
+		{"garbage\r\n", ""},
+	}
+
+	for _, test := range tests {
+		if ident := parseIdent(test.line); ident != test.ident {
+			t.Errorf("parseIdent(%q) = %q, want %q", test.line, ident, test.ident)
+		}
+	}
+}
+
+func TestUnverifiedIdent(t *testing.T) {
+	tests := []struct {
+		username, ident string
+	}{
+		{"user", "~user"},
+		{"averyveryverylongname", "~averyvery"},
+	}
+
+	for _, test := range tests {
+		if ident := unverifiedIdent(test.username); ident != test.ident {
+			t.Errorf("unverifiedIdent(%q) = %q, want %q", test.username, ident, test.ident)
+		}
+	}
+}
@@ -8,7 +8,6 @@
 package client
 
 import "fmt"
-import "net"
 import "sync"
 
 import "oddcomm/src/core"
@@ -32,6 +31,10 @@ func Start() (msg chan string, exit chan int) {
 	msg = subsysMsg
 	exit = make(chan int)
 
+	// Hooked here rather than in init, so it runs after every module's
+	// registration hooks, such as bans, have had their say.
+	core.HookUserRegister(registered)
+
 	go clientMain(msg, exit)
 
 	return
@@ -48,19 +51,21 @@ func clientMain(msg chan string, exit chan int) {
 		supportLine += hook.h()
 	}
 
-	// Right now, we just bind to a fixed IP/port.
-	// No config parsing.
-	var addr net.TCPAddr
-	addr.IP = net.IPv4(127, 0, 0, 1)
-	addr.Port = 6667
-
-	// Start our listener.
-	l, err := net.ListenTCP("tcp4", &addr)
-	if err != nil {
-		fmt.Printf("No bind: %s\n", err)
+	// Start our listeners. TLS listeners need a certificate.
+	tlsErr := ReloadTLS()
+	if tlsErr != nil {
+		fmt.Printf("No TLS: %s\n", tlsErr)
+	}
+	for _, l := range Listen {
+		if l.TLS && tlsErr != nil {
+			continue
+		}
+		if err := AddListener(l); err != nil {
+			fmt.Printf("No bind: %s\n", err)
+		}
+	}
+	if len(Listeners()) == 0 {
 		exit <- 0
-	} else {
-		go listen(l)
 	}
 
 	var exiting bool
@@ -71,10 +76,8 @@ func clientMain(msg chan string, exit chan int) {
 		// If asked to exit...
 		if message == "exit" {
 
-			// Stop the listening goroutine.
-			if l != nil {
-				l.Close()
-			}
+			// Stop the listening goroutines.
+			closeListeners()
 
 
 			// Note that we're terminating, as soon as
@@ -105,35 +108,6 @@ func clientMain(msg chan string, exit chan int) {
 }
 
 
-// Listen goroutine function, handling listening for one socket.
-// Owns its socket.
-func listen(l *net.TCPListener) {
-
-	for {
-		c, err := l.AcceptTCP()
-		if err != nil {
-			core.Shutdown()
-			return
-		}
-
-		client := new(Client)
-		client.outchan = make(chan bool, 1)
-		client.conn = c
-		client.conn.SetWriteTimeout(1000)
-
-		ip := client.conn.RemoteAddr().(*net.TCPAddr).IP.String()
-		data := make([]core.DataChange, 2)
-		data[0].Name, data[0].Data = "ip", ip
-		data[1].Name, data[1].Data = "hostname", ip
-
-		client.u = core.NewUser(me, client, false, "", data)
-		incClient(client)
-
-		go input(client)
-	}
-}
-
-
 // Increment client count.
 // If we're exiting, kills the client immediately.
 // Must be called while holding the client mutex, and after adding the client's
@@ -165,13 +139,14 @@ func decClient(c *Client) {
 
 
 // GetClient looks up a Client corresponding to a given User.
+// If the user has several sessions attached, returns the most recently
+// attached; use GetClients to send to every session.
 // If no such Client exists, or the Client is disconnecting, returns nil.
 func GetClient(u *core.User) (c *Client) {
-
-	// Check whether they're marked as ours before getting their struct.
-	if u.Owner() != me {
+	clients := GetClients(u)
+	if len(clients) == 0 {
 		return nil
 	}
 
-	return u.Owndata().(*Client)
+	return clients[len(clients)-1]
 }
@@ -27,6 +27,20 @@ func init() {
 	c.Handler = cmdDie
 	c.OperFlag = "shutdown"
 	Commands.Add(c)
+
+	c = new(irc.Command)
+	c.Name = "REHASH"
+	c.Handler = cmdRehash
+	c.OperFlag = "rehash"
+	Commands.Add(c)
+
+	c = new(irc.Command)
+	c.Name = "LISTEN"
+	c.Handler = cmdListen
+	c.Minargs = 0
+	c.Maxargs = 50
+	c.OperFlag = "rehash"
+	Commands.Add(c)
 }
 
 func cmdKill(source interface{}, params [][]byte) {
@@ -63,3 +77,107 @@ func cmdKill(source interface{}, params [][]byte) {
 func cmdDie(source interface{}, params [][]byte) {
 	core.Shutdown()
 }
+
+func cmdRehash(source interface{}, params [][]byte) {
+	c := source.(*Client)
+
+	c.SendLineTo(nil, "382", "%s :Reloading TLS certificate.", TLSCert)
+	if err := ReloadTLS(); err != nil {
+		c.SendFrom(nil, "NOTICE %s :*** Unable to reload TLS certificate: %s", c.u.Nick(), err)
+	}
+}
+
+// LISTEN [LIST]
+// LISTEN ADD <network> <address> [tls] [websocket] [webirc] [class=<class>]
+//        [proxy=<mask>[,<mask>...]]
+// LISTEN DEL <network> <address>
+//
+// Lists, adds, or removes the addresses clients may connect to. Clients
+// connected to a removed listener are unaffected.
+func cmdListen(source interface{}, params [][]byte) {
+	c := source.(*Client)
+	u := c.User()
+
+	subcommand := "LIST"
+	if len(params) > 0 {
+		subcommand = strings.ToUpper(string(params[0]))
+	}
+
+	switch subcommand {
+	case "LIST":
+		for _, l := range Listeners() {
+			c.SendFrom(nil, "NOTICE %s :*** Listening on %s %s%s", u.Nick(), l.Network, l.Address, listenerFlags(l))
+		}
+		c.SendFrom(nil, "NOTICE %s :*** End of listeners.", u.Nick())
+
+	case "ADD":
+		if len(params) < 3 {
+			c.SendFrom(nil, "461 %s LISTEN :Not enough parameters.", u.Nick())
+			return
+		}
+		l := new(Listener)
+		l.Network = string(params[1])
+		l.Address = string(params[2])
+		for _, param := range params[3:] {
+			flag := string(param)
+			switch {
+			case flag == "tls":
+				l.TLS = true
+			case flag == "websocket":
+				l.WebSocket = true
+			case flag == "webirc":
+				l.WebIRC = true
+			case strings.HasPrefix(flag, "class="):
+				l.Class = flag[len("class="):]
+			case strings.HasPrefix(flag, "proxy="):
+				l.Proxy = true
+				l.ProxyFrom = strings.Split(flag[len("proxy="):], ",", -1)
+			default:
+				c.SendFrom(nil, "NOTICE %s :*** Unknown listener setting: %s", u.Nick(), flag)
+				return
+			}
+		}
+
+		if err := AddListener(l); err != nil {
+			c.SendFrom(nil, "NOTICE %s :*** Unable to listen on %s %s: %s", u.Nick(), l.Network, l.Address, err)
+			return
+		}
+		c.SendFrom(nil, "NOTICE %s :*** Now listening on %s %s%s", u.Nick(), l.Network, l.Address, listenerFlags(l))
+
+	case "DEL":
+		if len(params) < 3 {
+			c.SendFrom(nil, "461 %s LISTEN :Not enough parameters.", u.Nick())
+			return
+		}
+		network, address := string(params[1]), string(params[2])
+		if err := RemoveListener(network, address); err != nil {
+			c.SendFrom(nil, "NOTICE %s :*** Unable to stop listening on %s %s: %s", u.Nick(), network, address, err)
+			return
+		}
+		c.SendFrom(nil, "NOTICE %s :*** No longer listening on %s %s", u.Nick(), network, address)
+
+	default:
+		c.SendFrom(nil, "NOTICE %s :*** Unknown LISTEN subcommand: %s", u.Nick(), subcommand)
+	}
+}
+
+// Returns a listener's settings, as given to LISTEN ADD, each preceded by a
+// space.
+func listenerFlags(l *Listener) (flags string) {
+	if l.TLS {
+		flags += " tls"
+	}
+	if l.WebSocket {
+		flags += " websocket"
+	}
+	if l.WebIRC {
+		flags += " webirc"
+	}
+	if l.Class != "" {
+		flags += " class=" + l.Class
+	}
+	if l.Proxy {
+		flags += " proxy=" + strings.Join(l.ProxyFrom, ",")
+	}
+	return
+}
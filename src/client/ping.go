@@ -0,0 +1,164 @@
+package client
+
+import "crypto/rand"
+import "encoding/hex"
+import "fmt"
+import "io"
+import "time"
+
+import "oddcomm/src/core"
+import "oddcomm/lib/irc"
+
+
+// How long, in seconds, a client may be idle before we ping them, unless
+// their class says otherwise.
+var PingFrequency int64 = 90
+
+// How long, in seconds, a client has to reply to a ping before they're
+// disconnected.
+var PingTimeout int64 = 120
+
+// Whether clients must echo a random cookie we ping them with on connecting
+// before they may register, to stop connections from anything which isn't
+// an IRC client, such as web browsers tricked into connecting.
+var WaitPong bool = false
+
+// The package name we hold registration under until they echo the cookie.
+var pongHold string = "client/waitpong"
+
+
+func init() {
+	core.RegistrationHold(pongHold)
+
+	c := new(irc.Command)
+	c.Name = "PONG"
+	c.Handler = cmdPong
+	c.Minargs = 1
+	c.Maxargs = 2
+	c.Unregged = 1
+	c.Cost = -1
+	Commands.Add(c)
+}
+
+
+// Pings a client whenever they're idle for their ping frequency, and disconnects
+// them if they don't reply within PingTimeout. Any input counts as a reply.
+// If WaitPong is set, first pings them with a cookie they must echo before
+// registering. Run in its own goroutine once a client has connected.
+func pinger(c *Client) {
+	c.mutex.Lock()
+	c.lastInput = time.Nanoseconds()
+	c.mutex.Unlock()
+
+	sendCookie(c)
+
+	for {
+		frequency := PingFrequency
+		if class := c.getClass(); class.PingFrequency != 0 {
+			frequency = class.PingFrequency
+		}
+
+		c.mutex.Lock()
+		if c.disconnecting&1 != 0 {
+			c.mutex.Unlock()
+			return
+		}
+		idle := time.Nanoseconds() - c.lastInput
+		pinged := c.pinged
+		if idle >= frequency*1e9 {
+			c.pinged = true
+		}
+		c.mutex.Unlock()
+
+		// If they've not been idle long enough, wait until they have.
+		if idle < frequency*1e9 {
+			if !c.wait(frequency*1e9 - idle) {
+				return
+			}
+			continue
+		}
+
+		// If they've not been pinged yet, ping them.
+		if !pinged {
+			c.SendFrom(nil, "PING :%s", core.Global.Data("name"))
+			if !c.wait(PingTimeout * 1e9) {
+				return
+			}
+			continue
+		}
+
+		// If they've not replied in time, disconnect them.
+		if wait := (frequency+PingTimeout)*1e9 - idle; wait > 0 {
+			if !c.wait(wait) {
+				return
+			}
+			continue
+		}
+		c.mutex.Lock()
+		if c.disconnecting&1 == 0 {
+			c.delete(fmt.Sprintf("Ping timeout: %d seconds", idle/1e9))
+		}
+		c.mutex.Unlock()
+		return
+	}
+}
+
+// Waits the given number of nanoseconds, returning early if the client
+// disconnects. Returns false if they did.
+func (c *Client) wait(ns int64) bool {
+	select {
+	case <-time.After(ns):
+		return true
+	case <-c.done:
+		return false
+	}
+	panic("unreachable")
+}
+
+// Records input from a client, so they aren't pinged.
+func (c *Client) active() {
+	c.mutex.Lock()
+	c.lastInput = time.Nanoseconds()
+	c.pinged = false
+	c.mutex.Unlock()
+}
+
+// Pings a newly connected client with a cookie they must echo before
+// registering, if WaitPong is set, and otherwise permits registration.
+func sendCookie(c *Client) {
+	if !WaitPong {
+		c.User().PermitRegistration(pongHold)
+		return
+	}
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		c.User().PermitRegistration(pongHold)
+		return
+	}
+	cookie := hex.EncodeToString(buf)
+
+	c.mutex.Lock()
+	c.cookie = cookie
+	c.mutex.Unlock()
+
+	c.SendFrom(nil, "PING :%s", cookie)
+	c.SendFrom(nil, "NOTICE * :*** If you are having problems connecting due to ping timeouts, please type /quote PONG %s or /raw PONG %s now.", cookie, cookie)
+}
+
+
+func cmdPong(source interface{}, params [][]byte) {
+	c := source.(*Client)
+
+	c.mutex.Lock()
+	cookie := c.cookie
+	matched := cookie != "" && string(params[len(params)-1]) == cookie
+	if matched {
+		c.cookie = ""
+	}
+	c.mutex.Unlock()
+
+	if matched {
+		c.User().PermitRegistration(pongHold)
+	}
+}
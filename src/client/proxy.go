@@ -0,0 +1,146 @@
+package client
+
+import "bytes"
+import "io"
+import "net"
+import "os"
+import "strings"
+
+
+// How long, in seconds, a proxy has to send the PROXY protocol header.
+var ProxyTimeout int64 = 30
+
+// The signature starting a PROXY protocol version 2 header.
+var proxySig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+
+// Returns whether a client's connection comes from a trusted proxy, which
+// will send a PROXY protocol header first.
+func fromProxy(c *Client) bool {
+	if c.listener == nil || !c.listener.Proxy {
+		return false
+	}
+
+	ip := remoteIP(c.conn)
+	for _, mask := range c.listener.ProxyFrom {
+		if matchIP(ip, mask) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads a PROXY protocol header, version 1 or 2, from a client's connection,
+// and updates their "ip" and "hostname" data to the address given in it.
+// Headers for unknown or local connections leave them unchanged.
+// Must be called from the client's input goroutine before reading input.
+func readProxy(c *Client) os.Error {
+	c.conn.SetReadTimeout(ProxyTimeout * 1e9)
+	defer c.conn.SetReadTimeout(0)
+
+	// Read enough to tell the two versions apart.
+	buf := make([]byte, 8, 16)
+	if _, err := io.ReadFull(c.conn, buf); err != nil {
+		return err
+	}
+
+	var ip net.IP
+	var err os.Error
+	if bytes.HasPrefix(proxySig, buf) {
+		ip, err = readProxyV2(c, buf)
+	} else if bytes.HasPrefix(buf, []byte("PROXY ")) {
+		ip, err = readProxyV1(c, buf)
+	} else {
+		err = os.NewError("Invalid PROXY header.")
+	}
+
+	if err == nil && ip != nil {
+		c.u.SetData(nil, nil, "ip", ipData(ip))
+		c.u.SetData(nil, nil, "hostname", ipData(ip))
+	}
+
+	return err
+}
+
+// Reads the rest of a version 1 header, given what we've read so far,
+// returning the source address, or nil if there is none.
+func readProxyV1(c *Client, buf []byte) (net.IP, os.Error) {
+
+	// Read a byte at a time until the end of the line, so we read no more
+	// than the header.
+	b := make([]byte, 1)
+	for buf[len(buf)-1] != '\n' {
+		if len(buf) == 107 {
+			return nil, os.NewError("Invalid PROXY header.")
+		}
+		if _, err := io.ReadFull(c.conn, b); err != nil {
+			return nil, err
+		}
+		buf = append(buf, b[0])
+	}
+
+	// PROXY <protocol> <source> <destination> <source port> <dest port>
+	fields := strings.Fields(string(buf))
+	if len(fields) < 2 {
+		return nil, os.NewError("Invalid PROXY header.")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, os.NewError("Invalid PROXY header.")
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, os.NewError("Invalid PROXY header.")
+	}
+
+	return ip, nil
+}
+
+// Reads the rest of a version 2 header, given what we've read so far,
+// returning the source address, or nil if there is none.
+func readProxyV2(c *Client, buf []byte) (net.IP, os.Error) {
+
+	// Read the rest of the fixed part of the header.
+	buf = buf[:16]
+	if _, err := io.ReadFull(c.conn, buf[8:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(buf[:12], proxySig) || buf[12]>>4 != 2 {
+		return nil, os.NewError("Invalid PROXY header.")
+	}
+
+	// Read the addresses, and any extensions we ignore.
+	length := int(buf[14])<<8 | int(buf[15])
+	addrs := make([]byte, length)
+	if _, err := io.ReadFull(c.conn, addrs); err != nil {
+		return nil, err
+	}
+
+	// LOCAL connections are the proxy's own, and have no address.
+	if buf[12]&0xF == 0 {
+		return nil, nil
+	}
+	if buf[12]&0xF != 1 {
+		return nil, os.NewError("Invalid PROXY header.")
+	}
+
+	switch buf[13] {
+	case 0x11: // TCP over IPv4.
+		if length < 12 {
+			return nil, os.NewError("Invalid PROXY header.")
+		}
+		return net.IPv4(addrs[0], addrs[1], addrs[2], addrs[3]), nil
+
+	case 0x21: // TCP over IPv6.
+		if length < 36 {
+			return nil, os.NewError("Invalid PROXY header.")
+		}
+		return net.IP(addrs[:16]), nil
+	}
+
+	// Other address families have no address we can use.
+	return nil, nil
+}
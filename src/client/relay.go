@@ -0,0 +1,110 @@
+package client
+
+import "strconv"
+
+import "oddcomm/src/core"
+import "oddcomm/lib/irc"
+
+
+// Messages to users and channel members on other nodes are relayed through
+// the core to the entities the users and channels are linked to by their
+// "entity" data. A user's entity carries the "node" they are on, the "user"
+// ID they have there, and their "nick", "ident" and "hostname"; a channel's
+// entity carries its "name", and an "attach <entity>" key for each member.
+func init() {
+	core.SetMessageHandler(deliverRelayed)
+
+	core.HookUserMessage("", func(_ interface{}, source, target *core.User, message []byte) {
+		relayUser(source, target, "PRIVMSG", message)
+	})
+
+	core.HookUserMessage("noreply", func(_ interface{}, source, target *core.User, message []byte) {
+		relayUser(source, target, "NOTICE", message)
+	})
+
+	core.HookChanMessage("", "", func(_ interface{}, source *core.User, ch *core.Channel, message []byte) {
+		relayChan(source, ch, "PRIVMSG", message)
+	})
+
+	core.HookChanMessage("", "noreply", func(_ interface{}, source *core.User, ch *core.Channel, message []byte) {
+		relayChan(source, ch, "NOTICE", message)
+	})
+}
+
+
+// Returns the entity ID in the given data, or zero if none.
+func entityOf(data string) uint64 {
+	id, err := strconv.Atoui64(data)
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+// Returns whether the two given entities are on the same node. Messages
+// between them are delivered by that node's hooks, and are not relayed.
+func sameNode(a, b uint64) bool {
+	node := core.EntityData(a, "node")
+	return node != "" && node == core.EntityData(b, "node")
+}
+
+// Relay a message to a user on another node.
+func relayUser(source, target *core.User, kind string, message []byte) {
+	if source == nil {
+		return
+	}
+
+	from := entityOf(source.Data("entity"))
+	to := entityOf(target.Data("entity"))
+	if from == 0 || to == 0 || sameNode(from, to) {
+		return
+	}
+
+	core.SendMessage(from, to, kind, message)
+}
+
+// Relay a message to a channel's members on other nodes. Members on the
+// sender's node are skipped on delivery, having received it through its hooks.
+func relayChan(source *core.User, ch *core.Channel, kind string, message []byte) {
+	if source == nil {
+		return
+	}
+
+	from := entityOf(source.Data("entity"))
+	to := entityOf(ch.Data("entity"))
+	if from == 0 || to == 0 {
+		return
+	}
+
+	core.SendMessage(from, to, kind, message)
+}
+
+// Deliver a relayed message to one of its recipients, on this node.
+func deliverRelayed(source, target, recipient uint64, kind string, body []byte) {
+	if kind != "PRIVMSG" && kind != "NOTICE" {
+		return
+	}
+
+	// The sender's own node has delivered it to its users already.
+	if sameNode(source, recipient) {
+		return
+	}
+
+	u := core.GetUser(core.EntityData(recipient, "user"))
+	if u == nil {
+		return
+	}
+
+	from := core.EntityData(source, "nick") + "!" +
+		core.EntityData(source, "ident") + "@" +
+		core.EntityData(source, "hostname")
+
+	to := u.Nick()
+	if target != recipient {
+		to = "#" + core.EntityData(target, "name")
+	}
+
+	for _, c := range GetClients(u) {
+		irc.SendFrom(c, from, "%s %s :%s", kind, to, body)
+	}
+}
@@ -0,0 +1,186 @@
+package client
+
+import "strings"
+import "sync"
+import "time"
+
+import "oddcomm/src/core"
+
+
+// How long, in seconds, a user logged into an account is kept after their
+// last session detaches, permitting another to attach. Zero quits them
+// as soon as their last session detaches.
+var SessionGrace int64 = 300
+
+
+// The client sessions attached to one of our users.
+// A new connection logged into an account attaches, once it has registered, to
+// an existing user logged into that account, if there is one.
+type sessions struct {
+	mutex   sync.Mutex
+	clients []*Client
+	detach  uint // Incremented whenever the last session detaches.
+}
+
+
+// GetClients returns every client session attached to the given user, in the
+// order they attached. If the user is not ours, returns nil.
+func GetClients(u *core.User) []*Client {
+
+	// Check whether they're marked as ours before getting their struct.
+	if u.Owner() != me {
+		return nil
+	}
+
+	s := u.Owndata().(*sessions)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	list := make([]*Client, len(s.clients))
+	copy(list, s.clients)
+
+	return list
+}
+
+// Returns one of our registered users logged into the given account,
+// other than the given user, or nil if there is none.
+func findSession(account string, not *core.User) (found *core.User) {
+	if account == "" {
+		return nil
+	}
+
+	account = strings.ToUpper(account)
+	core.IterateUsers(me, func(u *core.User) {
+		if found == nil && u != not && u.Owner() == me &&
+			u.Registered() &&
+			strings.ToUpper(u.Data("account")) == account {
+			found = u
+		}
+	})
+
+	return
+}
+
+// Welcomes a client whose user has just registered, or if they're logged into
+// an account another of our users is, attaches them to that user instead.
+// Hooked on registration, after any other hook which might delete the user.
+func registered(_ interface{}, u *core.User) {
+	c := GetClient(u)
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	gone := c.disconnecting&1 != 0
+	c.mutex.Unlock()
+	if gone {
+		return
+	}
+
+	if found := findSession(u.Data("account"), u); found != nil {
+		attach(c, found)
+		return
+	}
+
+	welcome(c)
+	sendOffline(c)
+}
+
+// Attaches a client whose user has just registered to an existing user,
+// deleting its own user, then sends it the existing user's state.
+func attach(c *Client, u *core.User) {
+	c.mutex.Lock()
+	old := c.u
+	c.mutex.Unlock()
+
+	// Remove the client from its own user, so its deletion leaves the
+	// client alone.
+	olds := old.Owndata().(*sessions)
+	olds.mutex.Lock()
+	olds.clients = nil
+	olds.mutex.Unlock()
+
+	// Add it to the existing user, stopping any pending quit.
+	s := u.Owndata().(*sessions)
+	s.mutex.Lock()
+	s.clients = append(s.clients, c)
+	s.detach++
+	s.mutex.Unlock()
+
+	c.mutex.Lock()
+	c.u = u
+	c.mutex.Unlock()
+	old.Delete(me, nil, "Attached to existing session")
+
+	welcome(c)
+	sendOffline(c)
+
+	// Send them their channels concurrently, since NAMES can block.
+	go func() {
+		for ch := u.Channels(); ch != nil; ch = ch.UserNext() {
+			channel := ch.Channel()
+			c.SendFrom(u, "JOIN #%s", channel.Name())
+			cmdNames(c, [][]byte{[]byte(channel.Name())})
+			if topic, setby, setat := channel.GetTopic(); topic != "" {
+				c.SendLineTo(nil, "332", "#%s :%s", channel.Name(),
+					topic)
+				c.SendLineTo(nil, "333", "#%s %s %s",
+					channel.Name(), setby, setat)
+			}
+		}
+	}()
+}
+
+// Detaches a disconnecting client from its user. If it was the user's last
+// session, the user is deleted with the given source and message; once
+// SessionGrace has passed without another session attaching if they are
+// registered and logged into an account, and immediately otherwise.
+// Must be called with the client mutex held.
+func detach(c *Client, source *core.User, message string) {
+	u := c.u
+	s := u.Owndata().(*sessions)
+
+	s.mutex.Lock()
+	for i, other := range s.clients {
+		if other == c {
+			copy(s.clients[i:], s.clients[i+1:])
+			s.clients = s.clients[:len(s.clients)-1]
+			break
+		}
+	}
+	remaining := len(s.clients)
+	if remaining == 0 {
+		s.detach++
+	}
+	generation := s.detach
+	s.mutex.Unlock()
+
+	// If other sessions remain, we're done.
+	if remaining != 0 {
+		return
+	}
+
+	if !u.Registered() || u.Data("account") == "" || SessionGrace == 0 {
+		u.Delete(me, source, message)
+		return
+	}
+
+	go func() {
+		time.Sleep(SessionGrace * 1e9)
+
+		s.mutex.Lock()
+		expired := len(s.clients) == 0 && s.detach == generation
+		s.mutex.Unlock()
+
+		if expired {
+			u.Delete(me, source, message)
+		}
+	}()
+}
+
+// Returns whether the given user is ours, logged into an account, and has no
+// sessions attached, so messages to them should be stored until one attaches.
+func detached(u *core.User) bool {
+	return u.Owner() == me && u.Data("account") != "" &&
+		len(GetClients(u)) == 0
+}
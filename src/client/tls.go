@@ -0,0 +1,79 @@
+package client
+
+import "crypto/sha256"
+import "crypto/tls"
+import "encoding/hex"
+import "os"
+import "sync"
+
+
+// The files the TLS certificate and key for client connections are loaded
+// from, as written by gencert.sh. May only be changed before starting the
+// subsystem; use ReloadTLS to load them again afterwards.
+var TLSCert string = "oddcomm.crt"
+var TLSKey string = "oddcomm.key"
+
+// How long, in seconds, a client has to complete the TLS handshake.
+var TLSTimeout int64 = 30
+
+// The configuration new TLS connections are made with; nil if it has not been
+// loaded successfully.
+var tlsConfig *tls.Config
+var tlsMutex sync.Mutex
+
+
+// ReloadTLS loads the TLS certificate and key again. Connections made after it
+// returns use them; existing connections keep using the old ones. If loading
+// fails, the old certificate and key stay in use.
+func ReloadTLS() os.Error {
+	cert, err := tls.LoadX509KeyPair(TLSCert, TLSKey)
+	if err != nil {
+		return err
+	}
+
+	// Request but don't require certificates from clients, so we can
+	// record their fingerprints.
+	config := new(tls.Config)
+	config.Certificates = []tls.Certificate{cert}
+	config.AuthenticateClient = true
+
+	tlsMutex.Lock()
+	tlsConfig = config
+	tlsMutex.Unlock()
+
+	return nil
+}
+
+// Returns the configuration new TLS connections should use, or nil if there
+// is none.
+func getTLSConfig() *tls.Config {
+	tlsMutex.Lock()
+	defer tlsMutex.Unlock()
+
+	return tlsConfig
+}
+
+// Performs the TLS handshake for a client, recording the fingerprint of their
+// certificate if they sent one. Returns whether the handshake succeeded.
+// Must be called from the client's input goroutine before reading input.
+func handshake(c *Client, conn *tls.Conn) bool {
+	conn.SetReadTimeout(TLSTimeout * 1e9)
+	if err := conn.Handshake(); err != nil {
+		return false
+	}
+	conn.SetReadTimeout(0)
+
+	if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		c.u.SetData(nil, nil, "certfp", Fingerprint(certs[0].Raw))
+	}
+
+	return true
+}
+
+// Fingerprint returns the fingerprint of a DER-encoded certificate, as
+// recorded in the "certfp" metadata of users connected with one.
+func Fingerprint(cert []byte) string {
+	h := sha256.New()
+	h.Write(cert)
+	return hex.EncodeToString(h.Sum())
+}
@@ -5,6 +5,8 @@ import "strings"
 import "time"
 
 import "oddcomm/src/core"
+import "oddcomm/src/offline"
+import "oddcomm/lib/filter"
 import "oddcomm/lib/perm"
 import "oddcomm/lib/irc"
 
@@ -43,6 +45,7 @@ func init() {
 	c.Handler = cmdQuit
 	c.Maxargs = 1
 	c.Unregged = 1
+	c.Cost = -1
 	Commands.Add(c)
 
 	c = new(irc.Command)
@@ -109,7 +112,7 @@ func cmdUser(source interface{}, params [][]byte) {
 		return
 	}
 
-	ident := "~" + string(params[0])
+	ident := unverifiedIdent(string(params[0]))
 	real := string(params[3])
 
 	// Check that the ident and realname are valid.
@@ -126,6 +129,14 @@ func cmdUser(source interface{}, params [][]byte) {
 	data[0].Name, data[0].Data = "ident", ident
 	data[1].Name, data[1].Data = "real", real
 	c.u.SetDataList(me, nil, data)
+
+	// If their ident server has told us their ident, use that instead.
+	c.mutex.Lock()
+	looked := c.ident
+	c.mutex.Unlock()
+	if looked != "" {
+		c.u.SetData(nil, nil, "ident", looked)
+	}
 }
 
 func cmdPing(source interface{}, params [][]byte) {
@@ -314,12 +325,32 @@ func cmdPrivmsg(source interface{}, params [][]byte) {
 	targets := strings.Split(string(params[0]), ",", -1)
 	for _, t := range targets {
 		if target := core.GetUserByNick(string(t)); target != nil {
-			if ok, err := perm.CheckUserMsg(me, c.u, target, params[1], ""); ok {
+			message, err := filter.UserMsg(c.u, target, params[1], "")
+			if err != nil {
+				c.SendLineTo(nil, "404", "%s :%s", target.Nick(), err)
+				continue
+			}
+			if ok, err := perm.CheckUserMsg(me, c.u, target, message, ""); ok {
 				if v := target.Data("away"); v != "" {
 					c.SendLineTo(nil, "301", "%s :%s",
 						target.Nick(), v)
 				}
-				target.Message(me, c.u, params[1], "")
+				target.Message(me, c.u, message, "")
+
+				// Echo and store it as the target is given it.
+				out, err := filter.UserMsgTo(c.u, target, message, "")
+				if err != nil {
+					continue
+				}
+				c.sendOthers("PRIVMSG %s :%s", target.Nick(), out)
+				if detached(target) {
+					from := c.u.Nick() + "!" + c.u.GetIdent() + "@" + Hostname(target, c.u)
+					if err := offline.Store(c.u, target, from, out, ""); err == nil {
+						c.SendFrom(nil, "NOTICE %s :*** %s is offline; your message will be delivered when they return.", c.u.Nick(), target.Nick())
+					} else {
+						c.SendLineTo(nil, "404", "%s :%s", target.Nick(), err)
+					}
+				}
 			} else {
 				c.SendLineTo(nil, "404", "%s :%s", target.Nick(), err)
 			}
@@ -330,9 +361,17 @@ func cmdPrivmsg(source interface{}, params [][]byte) {
 			channame := string(t[1:])
 			ch := core.FindChannel("", channame)
 			if ch != nil {
+				message, err := filter.ChanMsg(c.u, ch, params[1], "")
+				if err != nil {
+					c.SendLineTo(nil, "404", "#%s :%s", ch.Name(), err)
+					continue
+				}
 				if ok, err := perm.CheckChanMsg(c.u, ch,
-					params[1], ""); ok {
-					ch.Message(me, c.u, params[1], "")
+					message, ""); ok {
+					ch.Message(me, c.u, message, "")
+					if echo, err := filter.ChanMsgTo(c.u, ch, c.u, message, ""); err == nil {
+						c.sendOthers("PRIVMSG #%s :%s", ch.Name(), echo)
+					}
 				} else {
 					c.SendLineTo(nil, "404", "#%s :%s", ch.Name(), err)
 				}
@@ -350,9 +389,25 @@ func cmdNotice(source interface{}, params [][]byte) {
 	targets := strings.Split(string(params[0]), ",", -1)
 	for _, t := range targets {
 		if target := core.GetUserByNick(string(t)); target != nil {
-			if ok, err := perm.CheckUserMsg(me, c.u, target, params[1],
+			message, err := filter.UserMsg(c.u, target, params[1], "noreply")
+			if err != nil {
+				c.SendLineTo(nil, "404", "%s :%s", target.Nick(), err)
+				continue
+			}
+			if ok, err := perm.CheckUserMsg(me, c.u, target, message,
 				"noreply"); ok {
-				target.Message(me, c.u, params[1], "noreply")
+				target.Message(me, c.u, message, "noreply")
+
+				// Echo and store it as the target is given it.
+				out, err := filter.UserMsgTo(c.u, target, message, "noreply")
+				if err != nil {
+					continue
+				}
+				c.sendOthers("NOTICE %s :%s", target.Nick(), out)
+				if detached(target) {
+					from := c.u.Nick() + "!" + c.u.GetIdent() + "@" + Hostname(target, c.u)
+					offline.Store(c.u, target, from, out, "noreply")
+				}
 			} else {
 				c.SendLineTo(nil, "404", "%s :%s", target.Nick(), err)
 			}
@@ -363,9 +418,17 @@ func cmdNotice(source interface{}, params [][]byte) {
 			channame := string(t[1:])
 			ch := core.FindChannel("", channame)
 			if ch != nil {
+				message, err := filter.ChanMsg(c.u, ch, params[1], "noreply")
+				if err != nil {
+					c.SendLineTo(nil, "404", "#%s :%s", ch.Name(), err)
+					continue
+				}
 				if ok, err := perm.CheckChanMsg(c.u, ch,
-					params[1], " noreply"); ok {
-					ch.Message(me, c.u, params[1], "noreply")
+					message, " noreply"); ok {
+					ch.Message(me, c.u, message, "noreply")
+					if echo, err := filter.ChanMsgTo(c.u, ch, c.u, message, "noreply"); err == nil {
+						c.sendOthers("NOTICE #%s :%s", ch.Name(), echo)
+					}
 				} else {
 					c.SendLineTo(nil, "404", "#%s :%s", ch.Name(), err)
 				}
@@ -400,9 +463,16 @@ func cmdAway(source interface{}, params [][]byte) {
 func cmdQuit(source interface{}, params [][]byte) {
 	c := source.(*Client)
 
+	var message string
 	if len(params) > 0 {
-		c.u.Delete(me, c.u, string(params[0]))
-	} else {
-		c.u.Delete(me, c.u, "")
+		if reason, err := filter.Quit(c.u, params[0]); err == nil {
+			message = string(reason)
+		}
 	}
+
+	// Only this session quits; the user quits with it if it was their
+	// last session.
+	c.mutex.Lock()
+	c.deleteFrom(c.u, message, "Quit: "+message)
+	c.mutex.Unlock()
 }
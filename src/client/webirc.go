@@ -0,0 +1,101 @@
+package client
+
+import "crypto/subtle"
+import "net"
+import "strings"
+
+import "oddcomm/lib/irc"
+
+
+// Gateway describes a web chat gateway, or other trusted proxy, which may
+// pass on the addresses of users connecting through it with WEBIRC.
+type Gateway struct {
+	// The gateway's name, recorded in the "webirc" data of users
+	// connecting through it.
+	Name string
+
+	// The password the gateway must send.
+	Password string
+
+	// Masks or CIDR ranges matching the IPs the gateway may connect from.
+	From []string
+}
+
+// Gateways permitted to use WEBIRC, on listeners which allow it.
+// May only be changed before starting the subsystem.
+var Gateways []*Gateway
+
+
+func init() {
+	c := new(irc.Command)
+	c.Name = "WEBIRC"
+	c.Handler = cmdWebirc
+	c.Minargs = 4
+	c.Maxargs = 5
+	c.Unregged = 2
+	Commands.Add(c)
+}
+
+
+// WEBIRC <password> <gateway> <hostname> <ip> [:<options>]
+func cmdWebirc(source interface{}, params [][]byte) {
+	c := source.(*Client)
+
+	// Only one WEBIRC is permitted, and only before anything else.
+	webirced := c.webirced
+	c.webirced = true
+	if webirced || c.listener == nil || !c.listener.WebIRC ||
+		c.nicked || c.u.Data("ident") != "" {
+		webircFail(c)
+		return
+	}
+
+	// Find the gateway they named, if they're connecting from it with its
+	// password.
+	ip := c.u.Data("ip")
+	var gateway *Gateway
+	for _, g := range Gateways {
+		if g.Name != string(params[1]) {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(g.Password), params[0]) != 1 {
+			continue
+		}
+		for _, mask := range g.From {
+			if matchIP(ip, mask) {
+				gateway = g
+			}
+		}
+	}
+	if gateway == nil {
+		webircFail(c)
+		return
+	}
+
+	// Check the address they gave is valid, and use it as the hostname if
+	// the hostname they gave isn't.
+	realip := net.ParseIP(string(params[3]))
+	if realip == nil {
+		webircFail(c)
+		return
+	}
+	hostname := string(params[2])
+	if hostname == "" || hostname[0] == ':' ||
+		strings.IndexAny(hostname, " @!") != -1 {
+		hostname = ipData(realip)
+	}
+
+	c.u.SetData(nil, nil, "ip", ipData(realip))
+	c.u.SetData(nil, nil, "hostname", hostname)
+	c.u.SetData(nil, nil, "webirc", gateway.Name)
+
+	// Their class may differ from their real address.
+	setClass(c)
+}
+
+// Disconnects a client which used WEBIRC without permission.
+func webircFail(c *Client) {
+	c.mutex.Lock()
+	c.delete("WEBIRC Not Permitted")
+	c.mutex.Unlock()
+}
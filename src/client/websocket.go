@@ -0,0 +1,318 @@
+package client
+
+import "bufio"
+import "bytes"
+import "crypto/sha1"
+import "encoding/base64"
+import "fmt"
+import "http"
+import "io"
+import "net"
+import "os"
+import "strings"
+import "sync"
+import "utf8"
+
+import "oddcomm/lib/irc"
+
+
+// How long, in seconds, a WebSocket client has to complete its handshake.
+var WebSocketTimeout int64 = 30
+
+// The largest WebSocket message we accept from clients.
+const maxWSMessage = 2096 + irc.MaxClientTagData
+
+// The GUID appended to WebSocket keys to make the accept key.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket frame opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+
+// A WebSocket connection carrying IRC, with each message holding one line.
+// Reads return the lines received, each ending in CRLF, and writes are split
+// into lines sent as one message each, so it looks like any other client
+// connection.
+type wsConn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	binary bool // Whether lines are sent in binary messages.
+
+	// Received lines not yet read.
+	in []byte
+
+	// Written data not yet sent; a partial line, and the unsent part of
+	// the last message.
+	wmutex  sync.Mutex
+	partial []byte
+	rest    []byte
+}
+
+
+// Performs the server side of the WebSocket handshake on a connection,
+// returning the WebSocket connection.
+func wsHandshake(conn net.Conn) (*wsConn, os.Error) {
+	conn.SetReadTimeout(WebSocketTimeout * 1e9)
+	defer conn.SetReadTimeout(0)
+
+	ws := new(wsConn)
+	ws.conn = conn
+	ws.r = bufio.NewReader(conn)
+
+	req, err := http.ReadRequest(ws.r)
+	if err != nil {
+		return nil, err
+	}
+
+	key := req.Header.Get("Sec-Websocket-Key")
+	if req.Method != "GET" || key == "" ||
+		strings.ToLower(req.Header.Get("Upgrade")) != "websocket" ||
+		req.Header.Get("Sec-Websocket-Version") != "13" {
+		fmt.Fprintf(conn, "HTTP/1.1 400 Bad Request\r\nSec-WebSocket-Version: 13\r\n\r\n")
+		return nil, os.NewError("Invalid WebSocket handshake.")
+	}
+
+	// Pick a subprotocol; text if they don't ask for one.
+	protocol := ""
+	for _, p := range strings.Split(req.Header.Get("Sec-Websocket-Protocol"), ",", -1) {
+		p = strings.TrimSpace(p)
+		if p == "binary.ircv3.net" || p == "text.ircv3.net" {
+			protocol = p
+			break
+		}
+	}
+	ws.binary = protocol == "binary.ircv3.net"
+
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	accept := base64.StdEncoding.EncodeToString(h.Sum())
+
+	response := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + accept + "\r\n"
+	if protocol != "" {
+		response += "Sec-WebSocket-Protocol: " + protocol + "\r\n"
+	}
+	response += "\r\n"
+	if _, err := io.WriteString(conn, response); err != nil {
+		return nil, err
+	}
+
+	return ws, nil
+}
+
+// Read reads received lines, each ending in CRLF.
+func (ws *wsConn) Read(b []byte) (int, os.Error) {
+	for len(ws.in) == 0 {
+		line, err := ws.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		ws.in = append(line, '\r', '\n')
+	}
+
+	n := copy(b, ws.in)
+	ws.in = ws.in[n:]
+	return n, nil
+}
+
+// Reads a data message from the client, handling control messages, and
+// returns its payload.
+func (ws *wsConn) readMessage() ([]byte, os.Error) {
+	var message []byte
+	for {
+		var header [2]byte
+		if _, err := io.ReadFull(ws.r, header[:]); err != nil {
+			return nil, err
+		}
+		fin := header[0]&0x80 != 0
+		opcode := header[0] & 0xF
+
+		// Clients must mask their frames.
+		if header[1]&0x80 == 0 {
+			return nil, os.NewError("Unmasked WebSocket frame.")
+		}
+
+		// Control frames must be short, and not fragmented.
+		length := uint64(header[1] & 0x7F)
+		if opcode&0x8 != 0 && (length > 125 || !fin) {
+			return nil, os.NewError("Invalid WebSocket control frame.")
+		}
+		if length >= 126 {
+			size := 2
+			if length == 127 {
+				size = 8
+			}
+			ext := make([]byte, size)
+			if _, err := io.ReadFull(ws.r, ext); err != nil {
+				return nil, err
+			}
+			length = 0
+			for _, b := range ext {
+				length = length<<8 | uint64(b)
+			}
+		}
+		if length > maxWSMessage-uint64(len(message)) {
+			return nil, os.NewError("WebSocket message too long.")
+		}
+
+		var mask [4]byte
+		if _, err := io.ReadFull(ws.r, mask[:]); err != nil {
+			return nil, err
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(ws.r, payload); err != nil {
+			return nil, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch opcode {
+		case wsClose:
+			ws.send(wsClose, nil)
+			return nil, os.EOF
+		case wsPing:
+			ws.send(wsPong, payload)
+			continue
+		case wsPong:
+			continue
+		case wsText, wsBinary, wsContinuation:
+			message = append(message, payload...)
+		default:
+			return nil, os.NewError("Unknown WebSocket opcode.")
+		}
+
+		if fin {
+			// Clients may end the line themselves.
+			return bytes.TrimRight(message, "\r\n"), nil
+		}
+	}
+
+	panic("unreachable")
+}
+
+// Write sends each complete line written as a message, keeping any partial
+// line until the rest is written. If the connection times out partway through
+// sending a message, returns how much was consumed along with the error, and
+// the rest of the message is sent before anything else.
+func (ws *wsConn) Write(b []byte) (int, os.Error) {
+	ws.wmutex.Lock()
+	defer ws.wmutex.Unlock()
+
+	if err := ws.flush(); err != nil {
+		return 0, err
+	}
+
+	written := 0
+	for {
+		end := bytes.IndexByte(b[written:], '\n')
+		if end == -1 {
+			break
+		}
+		end += written + 1
+
+		line := append(ws.partial, b[written:end]...)
+		ws.partial = nil
+		written = end
+
+		opcode := byte(wsBinary)
+		line = bytes.TrimRight(line, "\r\n")
+		if !ws.binary {
+			opcode = wsText
+
+			// Text messages must be valid UTF-8.
+			if !utf8.Valid(line) {
+				line = []byte(string([]int(string(line))))
+			}
+		}
+
+		ws.rest = frame(opcode, line)
+		if err := ws.flush(); err != nil {
+			return written, err
+		}
+	}
+
+	ws.partial = append(ws.partial, b[written:]...)
+	return len(b), nil
+}
+
+// Sends a control message. Used from the input goroutine.
+func (ws *wsConn) send(opcode byte, payload []byte) {
+	ws.wmutex.Lock()
+	defer ws.wmutex.Unlock()
+
+	ws.rest = append(ws.rest, frame(opcode, payload)...)
+	ws.flush()
+}
+
+// Sends the unsent part of the last message. Must be called with the write
+// mutex held.
+func (ws *wsConn) flush() os.Error {
+	for len(ws.rest) > 0 {
+		n, err := ws.conn.Write(ws.rest)
+		ws.rest = ws.rest[n:]
+		if err != nil {
+			return err
+		}
+	}
+	ws.rest = nil
+	return nil
+}
+
+// Returns a frame holding an entire message with the given opcode.
+func frame(opcode byte, payload []byte) []byte {
+	f := make([]byte, 0, len(payload)+10)
+	f = append(f, 0x80|opcode)
+
+	switch {
+	case len(payload) < 126:
+		f = append(f, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		f = append(f, 126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		f = append(f, 127)
+		for i := uint(56); i > 0; i -= 8 {
+			f = append(f, byte(uint64(len(payload))>>i))
+		}
+		f = append(f, byte(len(payload)))
+	}
+
+	return append(f, payload...)
+}
+
+// Close sends a close message if it can, and closes the connection.
+func (ws *wsConn) Close() os.Error {
+	ws.wmutex.Lock()
+	if len(ws.rest) == 0 {
+		ws.conn.Write(frame(wsClose, nil))
+	}
+	ws.wmutex.Unlock()
+
+	return ws.conn.Close()
+}
+
+func (ws *wsConn) LocalAddr() net.Addr {
+	return ws.conn.LocalAddr()
+}
+
+func (ws *wsConn) RemoteAddr() net.Addr {
+	return ws.conn.RemoteAddr()
+}
+
+func (ws *wsConn) SetTimeout(nsec int64) os.Error {
+	return ws.conn.SetTimeout(nsec)
+}
+
+func (ws *wsConn) SetReadTimeout(nsec int64) os.Error {
+	return ws.conn.SetReadTimeout(nsec)
+}
+
+func (ws *wsConn) SetWriteTimeout(nsec int64) os.Error {
+	return ws.conn.SetWriteTimeout(nsec)
+}
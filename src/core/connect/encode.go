@@ -0,0 +1,64 @@
+package connect
+
+import "bufio"
+import "errors"
+import "io"
+
+import proto "goprotobuf.googlecode.com/hg/proto"
+
+import "oddcomm/src/core/connect/mmn"
+
+// EncodeLine encodes an mmn.Line as it is sent on the wire;
+// marshalled, and prefixed by its length in varint format.
+func EncodeLine(line *mmn.Line) []byte {
+
+	buf, err := proto.Marshal(line)
+	if err != nil {
+		panic("Error marshalling protobuf struct.")
+	}
+
+	return append(proto.EncodeVarint(uint64(len(buf))), buf...)
+}
+
+// DecodeLine reads a single length-prefixed mmn.Line from the given reader,
+// as written by EncodeLine. Returns io.EOF if the reader was already at its
+// end, and io.ErrUnexpectedEOF if it ended partway through a line.
+func DecodeLine(r *bufio.Reader) (*mmn.Line, error) {
+
+	// Read the varint length prefix.
+	var lenBuf []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF && len(lenBuf) != 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		lenBuf = append(lenBuf, b)
+		if b < 0x80 {
+			break
+		}
+		if len(lenBuf) == 10 {
+			return nil, errors.New("Overlong line length.")
+		}
+	}
+	length, _ := proto.DecodeVarint(lenBuf)
+
+	// Read and parse the line.
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	line := new(mmn.Line)
+	if err := proto.Unmarshal(buf, line); err != nil {
+		return nil, err
+	}
+
+	return line, nil
+}
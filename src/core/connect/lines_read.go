@@ -0,0 +1,24 @@
+package connect
+
+import "oddcomm/src/core/connect/mmn"
+
+
+// Create a ReadIndexRequest line.
+func MakeReadIndexRequest(read uint64) *mmn.Line {
+
+	line := new(mmn.Line)
+	line.ReadIndexRequest = &read
+
+	return line
+}
+
+// Create a ReadIndex line.
+func MakeReadIndex(read, change uint64) *mmn.Line {
+
+	line := new(mmn.Line)
+	line.ReadIndex = new(mmn.ReadIndex)
+	line.ReadIndex.Read = &read
+	line.ReadIndex.Change = &change
+
+	return line
+}
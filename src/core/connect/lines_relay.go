@@ -0,0 +1,18 @@
+package connect
+
+import "oddcomm/src/core/connect/mmn"
+
+
+// Create a Message line.
+func MakeMessage(source, target uint64, recipients []uint64, kind string, body []byte) *mmn.Line {
+
+	line := new(mmn.Line)
+	line.Message = new(mmn.Message)
+	line.Message.Source = &source
+	line.Message.Target = &target
+	line.Message.Recipients = recipients
+	line.Message.Type = &kind
+	line.Message.Body = body
+
+	return line
+}
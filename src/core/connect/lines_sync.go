@@ -48,3 +48,74 @@ func MakeDegraded(degraded bool) *mmn.Line {
 
 	return line
 }
+
+// Create a Nonce line.
+func MakeNonce(change uint64) *mmn.Line {
+
+	line := new(mmn.Line)
+	line.Nonce = &change
+
+	return line
+}
+
+// Create a Desynchronized line.
+func MakeDesynchronized() *mmn.Line {
+
+	desynchronized := true
+	line := new(mmn.Line)
+	line.Desynchronized = &desynchronized
+
+	return line
+}
+
+// Create a Synchronized line.
+func MakeSynchronized() *mmn.Line {
+
+	synchronized := true
+	line := new(mmn.Line)
+	line.Synchronized = &synchronized
+
+	return line
+}
+
+// Create a Burst line.
+func MakeBurst() *mmn.Line {
+
+	burst := true
+	line := new(mmn.Line)
+	line.Burst = &burst
+
+	return line
+}
+
+// Create an EntitySync line.
+func MakeEntitySync(entity uint64, key, value string) *mmn.Line {
+
+	line := new(mmn.Line)
+	line.EntitySync = new(mmn.EntitySync)
+	line.EntitySync.Entity = &entity
+	line.EntitySync.Key = &key
+	line.EntitySync.Value = []byte(value)
+
+	return line
+}
+
+// Create a GlobalSync line.
+func MakeGlobalSync(key, value string) *mmn.Line {
+
+	line := new(mmn.Line)
+	line.GlobalSync = new(mmn.GlobalSync)
+	line.GlobalSync.Key = &key
+	line.GlobalSync.Value = []byte(value)
+
+	return line
+}
+
+// Create a Change line.
+func MakeChange(change *mmn.Change) *mmn.Line {
+
+	line := new(mmn.Line)
+	line.Change = change
+
+	return line
+}
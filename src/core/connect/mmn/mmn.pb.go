@@ -34,6 +34,9 @@ type Line struct {
 	ChangeNotification   *uint64        `protobuf:"varint,401,opt,name=change_notification" json:"change_notification,omitempty"`
 	ChangeContentRequest *uint64        `protobuf:"varint,402,opt,name=change_content_request" json:"change_content_request,omitempty"`
 	ChangeMissing        *uint64        `protobuf:"varint,403,opt,name=change_missing" json:"change_missing,omitempty"`
+	ReadIndexRequest     *uint64        `protobuf:"varint,501,opt,name=read_index_request" json:"read_index_request,omitempty"`
+	ReadIndex            *ReadIndex     `protobuf:"bytes,502,opt,name=read_index" json:"read_index,omitempty"`
+	Message              *Message       `protobuf:"bytes,601,opt,name=message" json:"message,omitempty"`
 	XXX_unrecognized     []byte         `json:",omitempty"`
 }
 
@@ -189,5 +192,26 @@ type ChangeMissing struct {
 func (this *ChangeMissing) Reset()         { *this = ChangeMissing{} }
 func (this *ChangeMissing) String() string { return proto.CompactTextString(this) }
 
+type ReadIndex struct {
+	Read             *uint64 `protobuf:"varint,1,req,name=read" json:"read,omitempty"`
+	Change           *uint64 `protobuf:"varint,2,req,name=change" json:"change,omitempty"`
+	XXX_unrecognized []byte  `json:",omitempty"`
+}
+
+func (this *ReadIndex) Reset()         { *this = ReadIndex{} }
+func (this *ReadIndex) String() string { return proto.CompactTextString(this) }
+
+type Message struct {
+	Source           *uint64  `protobuf:"varint,1,req,name=source" json:"source,omitempty"`
+	Target           *uint64  `protobuf:"varint,2,req,name=target" json:"target,omitempty"`
+	Recipients       []uint64 `protobuf:"varint,3,rep,name=recipients" json:"recipients,omitempty"`
+	Type             *string  `protobuf:"bytes,4,req,name=type" json:"type,omitempty"`
+	Body             []byte   `protobuf:"bytes,5,req,name=body" json:"body,omitempty"`
+	XXX_unrecognized []byte   `json:",omitempty"`
+}
+
+func (this *Message) Reset()         { *this = Message{} }
+func (this *Message) String() string { return proto.CompactTextString(this) }
+
 func init() {
 }
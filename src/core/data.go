@@ -0,0 +1,40 @@
+package core
+
+import "oddcomm/src/core/store"
+
+// EntityData returns the value of the given key on the given entity, or an
+// empty string if the entity or the key does not exist.
+func EntityData(id uint64, key string) string {
+	e := store.GetEntity(id)
+	if e == nil {
+		return ""
+	}
+	return e.Data(key)
+}
+
+// A consistency level for reads from the core's state.
+// Reads are always of local state; the level decides what Read waits for
+// before making them.
+type Consistency int
+
+const (
+	// Read local state as it stands. May be stale.
+	ReadLocal = Consistency(store.ReadLocal)
+
+	// Read local state once the change made by a given request ID has
+	// been applied, so the reader sees its own writes.
+	ReadMyWrites = Consistency(store.ReadMyWrites)
+
+	// Read local state once every change committed at the time of the
+	// read, as confirmed with the leader, has been applied.
+	ReadLinearizable = Consistency(store.ReadLinearizable)
+)
+
+// Read waits until the given consistency level is met, then calls f, which
+// may read the core's state with EntityData. request is the request ID of a
+// change the reader made, for ReadMyWrites, and is otherwise ignored.
+//
+// Returns an error without calling f if the level could not be met in time.
+func Read(level Consistency, request uint64, f func()) error {
+	return store.Read(store.Consistency(level), request, f)
+}
@@ -0,0 +1,313 @@
+package logic
+
+import "strconv"
+import "strings"
+import "sync"
+import "sync/atomic"
+import "time"
+
+import "oddcomm/src/core/connect/mmn"
+import "oddcomm/src/core/store"
+
+// How long applied changes are kept in the change list, for synchronising
+// nodes which reconnect. Must be set before Initialize.
+var ChangeListTime = 120 * time.Second
+
+// The most changes kept in the change list at once, regardless of their age.
+// Zero means no limit. Must be set before Initialize.
+var ChangeListMax = 100000
+
+// Statistics on change list retention.
+type RetentionStats struct {
+	Retained     int    // Changes currently in the change list.
+	Oldest       uint64 // Lowest change ID in the change list; 0 if empty.
+	ExpiredTime  uint64 // Changes removed for passing ChangeListTime.
+	ExpiredCount uint64 // Changes removed for passing ChangeListMax.
+	Resyncs      uint64 // Nodes synchronised from our change list.
+	BurstsSent   uint64 // Nodes told to fall back to a full burst.
+	BurstsNeeded uint64 // Times we were told to fall back to a burst.
+	Snapshots    uint64 // Snapshots written.
+	Snapshot     uint64 // Last change ID covered by the latest snapshot.
+
+	// Failed writes of snapshots or the change log.
+	PersistFailures uint64
+}
+
+// The last request nonce we generated. Starts from the time we started, in
+// the top bits, so nonces keep increasing across restarts.
+var lastRequest = uint64(time.Now().Unix()) << 16
+
+// NewRequest returns a new request ID for a change made by this node, for
+// use in its change request and for reading our own writes. Our node ID must
+// be set before calling this.
+func NewRequest() uint64 {
+	nonce := atomic.AddUint64(&lastRequest, 1) & (1<<store.RequestNonceBits - 1)
+	return uint64(Id)<<store.RequestNonceBits | nonce
+}
+
+// An applied change, and when it was applied.
+type appliedChange struct {
+	change *mmn.Change
+	at     time.Time
+}
+
+// Held while using the change list, change queue, or retention stats.
+var changeMutex sync.Mutex
+
+// Changes applied recently, in order of change ID.
+var changeList []appliedChange
+
+// Changes received but not yet applied, keyed by change ID.
+var changeQueue = make(map[uint64]*mmn.Change)
+
+// Lowest change IDs other nodes may still need from us while synchronising:
+// the nonce we sent them, in case they need a burst ending with the changes
+// from it, lowered to their own nonce if we're sending them changes from
+// that. Changes above these are not removed.
+var pins = make(map[*Node]uint64)
+
+// Whether we're receiving a burst. While we are, received changes are queued
+// but not applied, as the burst will replace our state.
+var bursting bool
+
+// Current retention statistics.
+var stats RetentionStats
+
+
+// Retention returns current change list retention statistics.
+func Retention() RetentionStats {
+	changeMutex.Lock()
+	defer changeMutex.Unlock()
+
+	trimChangeList()
+
+	result := stats
+	result.Retained = len(changeList)
+	if len(changeList) != 0 {
+		result.Oldest = *changeList[0].change.Id
+	}
+
+	return result
+}
+
+// Returns the lowest change ID not yet applied.
+func nextChange() uint64 {
+	return store.Applied() + 1
+}
+
+// Receive a Change line, queueing it, then applying every change in the queue
+// which is now next in order.
+func receiveChange(change *mmn.Change) {
+	changeMutex.Lock()
+	defer changeMutex.Unlock()
+
+	id := *change.Id
+	if id < nextChange() || changeQueue[id] != nil {
+		return
+	}
+	changeQueue[id] = change
+
+	applyQueued()
+}
+
+// Applies every change in the queue which is now next in order, unless we're
+// receiving a burst.
+// Must be called while holding the change mutex.
+func applyQueued() {
+	if bursting {
+		return
+	}
+
+	for {
+		next, ok := changeQueue[nextChange()]
+		if !ok {
+			break
+		}
+		delete(changeQueue, *next.Id)
+
+		applyChange(next)
+		logChange(next)
+		changeList = append(changeList, appliedChange{next, time.Now()})
+	}
+
+	trimChangeList()
+}
+
+// Apply a change to the store.
+// Name change handling is not yet implemented; names are applied as plain
+// sets and unsets. Unsetting "id" deletes the entity, as do changes to
+// "transient" and "attach <id>" keys leaving a transient entity with nothing
+// attached.
+// Must be called while holding the change mutex.
+func applyChange(change *mmn.Change) {
+	store.Lock()
+	defer store.Unlock()
+
+	for _, entry := range change.Changes {
+		key := *entry.Key
+		value := string(entry.Value)
+
+		if entry.Target == nil {
+			store.SetGlobal(key, value)
+			continue
+		}
+		target := *entry.Target
+
+		switch {
+		case key == "id" && value == "":
+			deleteEntity(target)
+
+		case key == "transient":
+			store.SetEntityData(target, key, value)
+			if value != "" && !attached(target) {
+				deleteEntity(target)
+			}
+
+		case strings.HasPrefix(key, "attach "):
+			// Attachments of entities which don't exist are
+			// discarded.
+			if value != "" {
+				id, err := strconv.ParseUint(key[len("attach "):], 10, 64)
+				if err != nil || store.GetEntity(id) == nil {
+					continue
+				}
+				store.SetEntityData(target, key, value)
+				continue
+			}
+
+			e := store.GetEntity(target)
+			if e == nil || e.Data(key) == "" {
+				continue
+			}
+			store.SetEntityData(target, key, "")
+			if e.Data("transient") != "" && !attached(target) {
+				deleteEntity(target)
+			}
+
+		default:
+			store.SetEntityData(target, key, value)
+		}
+	}
+
+	store.SetApplied(*change.Id, *change.Request)
+}
+
+// Returns whether any entity is attached to the given entity.
+// Must be called while holding the store's write lock.
+func attached(id uint64) (found bool) {
+	if e := store.GetEntity(id); e != nil {
+		e.DataRange("attach ", func(_, _ string) {
+			found = true
+		})
+	}
+	return
+}
+
+// Deletes the given entity, and detaches it from every entity it is attached
+// to, deleting any of those which are transient and now have nothing
+// attached, in turn.
+// Must be called while holding the store's write lock.
+func deleteEntity(id uint64) {
+	if store.GetEntity(id) == nil {
+		return
+	}
+	store.DeleteEntity(id)
+
+	key := "attach " + strconv.FormatUint(id, 10)
+	var detached []*store.Entity
+	store.EntityRange(func(e *store.Entity) {
+		if e.Data(key) != "" {
+			detached = append(detached, e)
+		}
+	})
+
+	for _, e := range detached {
+		store.SetEntityData(e.Id(), key, "")
+		if e.Data("transient") != "" && !attached(e.Id()) {
+			deleteEntity(e.Id())
+		}
+	}
+}
+
+// Returns every change in the change list and change queue with an ID at or
+// above the given one, in order. ok is false if the change list no longer
+// reaches back as far as that change ID.
+// Must be called while holding the change mutex.
+func changesFrom(id uint64) (changes []*mmn.Change, ok bool) {
+
+	// If they're not missing anything we've applied, they need only
+	// what is in the queue. Otherwise, we need the change they want.
+	if id < nextChange() {
+		if len(changeList) == 0 || *changeList[0].change.Id > id {
+			return nil, false
+		}
+	}
+
+	for _, c := range changeList {
+		if *c.change.Id >= id {
+			changes = append(changes, c.change)
+		}
+	}
+
+	for next := nextChange(); changeQueue[next] != nil; next++ {
+		if next >= id {
+			changes = append(changes, changeQueue[next])
+		}
+	}
+
+	return changes, true
+}
+
+// Prevents changes at or above the given ID being removed from the change
+// list, until unpin is called for the same node.
+// Must be called while holding the change mutex.
+func pin(n *Node, id uint64) {
+	pins[n] = id
+}
+
+// Removes a node's pin on the change list.
+// Must be called while holding the change mutex.
+func unpin(n *Node) {
+	delete(pins, n)
+}
+
+// Removes changes from the start of the change list which are older than
+// ChangeListTime, or in excess of ChangeListMax, except where pinned.
+// Must be called while holding the change mutex.
+func trimChangeList() {
+
+	// Find the lowest pinned change ID.
+	var floor uint64
+	for _, id := range pins {
+		if floor == 0 || id < floor {
+			floor = id
+		}
+	}
+
+	expiry := time.Now().Add(-ChangeListTime)
+
+	var remove int
+	for remove < len(changeList) {
+		c := changeList[remove]
+		if floor != 0 && *c.change.Id >= floor {
+			break
+		}
+
+		if ChangeListMax != 0 && len(changeList)-remove > ChangeListMax {
+			stats.ExpiredCount++
+		} else if c.at.Before(expiry) {
+			stats.ExpiredTime++
+		} else {
+			break
+		}
+		remove++
+	}
+
+	if remove != 0 {
+		copy(changeList, changeList[remove:])
+		for i := len(changeList) - remove; i < len(changeList); i++ {
+			changeList[i] = appliedChange{}
+		}
+		changeList = changeList[:len(changeList)-remove]
+	}
+}
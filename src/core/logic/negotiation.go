@@ -2,6 +2,7 @@ package logic
 
 import "oddcomm/src/core/connect"
 import "oddcomm/src/core/connect/mmn"
+import "oddcomm/src/core/store"
 
 
 // React to a line received from a node.
@@ -20,6 +21,34 @@ func (n *Node) receiveLine(line *mmn.Line) {
 
 		case line.Degraded != nil:
 			n.receiveDegraded(*line.Degraded)
+
+		case line.Nonce != nil:
+			n.receiveNonce(*line.Nonce)
+
+		case line.Desynchronized != nil:
+			n.receiveDesynchronized()
+
+		case line.Synchronized != nil:
+			n.receiveSynchronized()
+
+		case line.Burst != nil:
+			n.receiveBurst()
+
+		case line.EntitySync != nil, line.GlobalSync != nil:
+			n.receiveSync(line)
+
+		case line.Change != nil:
+			n.receiveChange(line.Change)
+
+		case line.ReadIndexRequest != nil:
+			n.receiveReadIndexRequest(*line.ReadIndexRequest)
+
+		case line.ReadIndex != nil:
+			n.receiveReadIndex(*line.ReadIndex.Read, *line.ReadIndex.Change)
+
+		case line.Message != nil:
+			m := line.Message
+			n.receiveMessage(*m.Source, *m.Target, m.Recipients, *m.Type, m.Body)
 	}
 }
 
@@ -168,8 +197,233 @@ func (n *Node) receiveDegraded(nodeDegraded bool) {
 		return
 	}
 
-	// SEND CHANGE NONCE
+	// Send our change nonce, and keep the changes above it until we're
+	// synchronised, in case the other node needs a burst, which ends with
+	// them.
+	changeMutex.Lock()
+	n.nonce = nextChange()
+	pin(n, n.nonce)
+	changeMutex.Unlock()
+	n.conn.WriteLine(connect.MakeNonce(n.nonce))
 
 	// Move into synchronisation state.
 	n.conn.State = connect.ConnStateSynchronization
 }
+
+func (n *Node) receiveNonce(change uint64) {
+
+	// If we're not in synchronisation state, error.
+	if n.conn.State != connect.ConnStateSynchronization {
+		n.conn.Close()
+		return
+	}
+
+	changeMutex.Lock()
+
+	// If they're ahead of us, remember their nonce; if we need a burst,
+	// our state will be theirs as of it. They'll send us what we're
+	// missing.
+	if change > nextChange() {
+		n.rnonce = change
+		changeMutex.Unlock()
+		return
+	}
+
+	// If our change list no longer goes back far enough, they'll need
+	// a burst.
+	changes, ok := changesFrom(change)
+	if !ok {
+		stats.BurstsSent++
+		changeMutex.Unlock()
+		n.conn.WriteLine(connect.MakeDesynchronized())
+		return
+	}
+
+	// Keep the changes from the nonce they acknowledged until they've
+	// confirmed they're synchronised.
+	if change < pins[n] {
+		pin(n, change)
+	}
+	stats.Resyncs++
+	changeMutex.Unlock()
+
+	// Otherwise, send them everything they're missing.
+	for _, c := range changes {
+		n.conn.WriteLine(connect.MakeChange(c))
+	}
+	n.conn.WriteLine(connect.MakeSynchronized())
+}
+
+func (n *Node) receiveDesynchronized() {
+
+	// If we're not in synchronisation state, error.
+	if n.conn.State != connect.ConnStateSynchronization {
+		n.conn.Close()
+		return
+	}
+
+	// We need their nonce to know where their burst leaves us, and may
+	// only receive one burst at once.
+	changeMutex.Lock()
+	if n.rnonce == 0 || bursting {
+		changeMutex.Unlock()
+		n.conn.Close()
+		return
+	}
+	stats.BurstsNeeded++
+	bursting = true
+	changeMutex.Unlock()
+
+	// Request a burst.
+	n.burst = nil
+	n.inBurst = true
+	n.conn.WriteLine(connect.MakeBurst())
+	n.conn.State = connect.ConnStateReceivingBurst
+}
+
+// Sends a burst of our state to a node we told was desynchronised, followed
+// by the changes from the nonce we sent them, which they'll apply on top.
+// Changes applied while the state is being sent may be reflected in it;
+// applying them again is harmless.
+func (n *Node) receiveBurst() {
+
+	// If we're not in synchronisation state, error.
+	if n.conn.State != connect.ConnStateSynchronization {
+		n.conn.Close()
+		return
+	}
+	n.conn.State = connect.ConnStateSendingBurst
+
+	store.EntityRange(func(e *store.Entity) {
+		e.DataRange("", func(key, value string) {
+			n.conn.WriteLine(connect.MakeEntitySync(e.Id(), key, value))
+		})
+	})
+	store.GlobalRange("", func(key, value string) {
+		n.conn.WriteLine(connect.MakeGlobalSync(key, value))
+	})
+
+	changeMutex.Lock()
+	changes, ok := changesFrom(n.nonce)
+	changeMutex.Unlock()
+	if !ok {
+		n.conn.Close()
+		return
+	}
+
+	for _, c := range changes {
+		n.conn.WriteLine(connect.MakeChange(c))
+	}
+	n.conn.WriteLine(connect.MakeSynchronized())
+}
+
+// Stages a line of a burst we're receiving, to be applied once it completes.
+func (n *Node) receiveSync(line *mmn.Line) {
+
+	// If we're not receiving a burst, error.
+	if n.conn.State != connect.ConnStateReceivingBurst {
+		n.conn.Close()
+		return
+	}
+
+	n.burst = append(n.burst, line)
+}
+
+func (n *Node) receiveSynchronized() {
+
+	switch n.conn.State {
+	case connect.ConnStateSynchronization:
+
+		// If we were behind them, they've now sent us everything
+		// we were missing; tell them we're synchronised too.
+		if n.rnonce != 0 {
+			n.conn.WriteLine(connect.MakeSynchronized())
+		}
+
+	case connect.ConnStateReceivingBurst:
+		n.finishBurst()
+		n.conn.WriteLine(connect.MakeSynchronized())
+
+	case connect.ConnStateSendingBurst:
+		// They've applied our burst.
+
+	default:
+		n.conn.Close()
+		return
+	}
+
+	// We no longer need to keep changes for them.
+	changeMutex.Lock()
+	unpin(n)
+	changeMutex.Unlock()
+
+	// Move into normal operating state.
+	n.rnonce = 0
+	n.conn.State = connect.ConnStateNormal
+}
+
+// Replaces our state with a burst we've received, as of the nonce the bursting
+// node sent us, then applies the changes queued since, and persists it.
+// If the snapshot fails, it's retried by the periodic snapshots.
+func (n *Node) finishBurst() {
+	changeMutex.Lock()
+
+	store.Lock()
+	store.Reset()
+	for _, line := range n.burst {
+		if sync := line.EntitySync; sync != nil {
+			store.SetEntityData(*sync.Entity, *sync.Key, string(sync.Value))
+		} else if sync := line.GlobalSync; sync != nil {
+			store.SetGlobal(*sync.Key, string(sync.Value))
+		}
+	}
+	store.SetApplied(n.rnonce-1, 0)
+	store.Unlock()
+
+	// Our change list is from before the burst, so it can't be used to
+	// synchronise other nodes; nor can queued changes we now have.
+	changeList = nil
+	for id := range changeQueue {
+		if id < nextChange() {
+			delete(changeQueue, id)
+		}
+	}
+
+	n.burst = nil
+	n.inBurst = false
+	bursting = false
+	applyQueued()
+	changeMutex.Unlock()
+
+	takeSnapshot()
+}
+
+// Abandons a burst we were receiving when its connection closed. Our state
+// was left untouched, so we carry on from it.
+func (n *Node) abortBurst() {
+	if !n.inBurst {
+		return
+	}
+
+	n.burst = nil
+	n.inBurst = false
+
+	changeMutex.Lock()
+	bursting = false
+	applyQueued()
+	changeMutex.Unlock()
+}
+
+func (n *Node) receiveChange(change *mmn.Change) {
+
+	// Changes are only accepted while synchronising, receiving a burst,
+	// or once synchronised.
+	if n.conn.State != connect.ConnStateSynchronization &&
+		n.conn.State != connect.ConnStateReceivingBurst &&
+		n.conn.State != connect.ConnStateNormal {
+		n.conn.Close()
+		return
+	}
+
+	receiveChange(change)
+}
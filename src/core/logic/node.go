@@ -24,7 +24,13 @@ type Node struct {
 	receive chan *mmn.Line // Channel received lines are sent to.
 	send    chan *mmn.Line // Channel lines to be sent are sent to.
 	connect chan bool      // A request to establish a connection.
+	read    chan uint64    // Read IDs to send read index requests for.
+	relay   chan *mmn.Line // Best-effort lines to be sent, or dropped.
 	waiting net.Conn       // Connection waiting for prev conn to die.
+	nonce   uint64         // Change nonce we sent on this connection.
+	rnonce  uint64         // Change nonce received, if ahead of ours.
+	burst   []*mmn.Line    // Sync lines of a burst being received.
+	inBurst bool           // Whether we're receiving a burst from them.
 }
 
 // Create a new node with the given ID and address.
@@ -38,6 +44,8 @@ func NewNode(id uint16, connInfo *connect.ConnInfo) *Node {
 	n.NewConn = make(chan net.Conn, 10)
 	n.send = make(chan *mmn.Line, 10)
 	n.connect = make(chan bool, 1)
+	n.read = make(chan uint64, 10)
+	n.relay = make(chan *mmn.Line, 100)
 
 	// Add to node list.
 	Nodes = append(Nodes, n)
@@ -54,6 +62,16 @@ func NewNode(id uint16, connInfo *connect.ConnInfo) *Node {
 	return n
 }
 
+// Returns the node with the given ID, or nil if there is none.
+func GetNode(id uint16) *Node {
+	for _, n := range Nodes {
+		if n.Id == id {
+			return n
+		}
+	}
+	return nil
+}
+
 // The node's goroutine. Handle lines sent to or received from this node.
 // TODO: Figure out how not to deadlock when two nodes send to each other.
 // Use an intermediary?
@@ -74,6 +92,14 @@ func (n *Node) process() {
 
 			n.receive = nil // Stop us selecting on closed chan.
 
+			// We no longer need to keep changes for them, and any
+			// burst from them is incomplete.
+			changeMutex.Lock()
+			unpin(n)
+			changeMutex.Unlock()
+			n.abortBurst()
+			n.rnonce = 0
+
 			// If we have a waiting incoming connection, take that.
 			if n.waiting != nil {
 				n.conn = connect.NewIncoming(n.waiting)
@@ -102,6 +128,14 @@ func (n *Node) process() {
 			// Send the line.
 			n.sendSyncLine(line)
 
+		// Send a best-effort line, if we're synchronised.
+		case line := <-n.relay:
+			n.sendNowLine(line)
+
+		// Send a read index request, if we're synchronised.
+		case read := <-n.read:
+			n.sendReadIndexRequest(read)
+
 		// Handle a new connection from this node.
 		case conn := <-n.NewConn:
 
@@ -187,6 +221,19 @@ func (n *Node) sendSyncLine(line *mmn.Line) {
 	}
 }
 
+// Send a line to the node if we have a synchronized connection to it now.
+// Otherwise, drop it; used for best-effort lines, which aren't queued.
+// Must be run from the node's goroutine.
+func (n *Node) sendNowLine(line *mmn.Line) {
+	if n.conn == nil || n.conn.State != connect.ConnStateNormal {
+		return
+	}
+
+	if err := n.conn.WriteLine(line); err != nil {
+		n.conn.Close()
+	}
+}
+
 
 // Ask each node's goroutine to attempt an outgoing connection to that node.
 // Nodes which already have a connection are skipped.
@@ -0,0 +1,327 @@
+package logic
+
+import "bufio"
+import "errors"
+import "io"
+import "os"
+import "strconv"
+import "time"
+
+import "oddcomm/src/core/connect"
+import "oddcomm/src/core/connect/mmn"
+import "oddcomm/src/core/store"
+
+// How often a snapshot of the store is written, permitting the persisted
+// change log to be truncated. Must be set before Initialize.
+var SnapshotInterval = 5 * time.Minute
+
+// The persisted change log, opened for appending.
+var changeLog *os.File
+
+
+// Load loads the store from our latest snapshot and change log, if any, then
+// opens the change log for writing and starts taking periodic snapshots.
+// Our node ID must be set before calling this.
+func Load() error {
+	if err := loadFiles(); err != nil {
+		return err
+	}
+
+	// Take a fresh snapshot, which also rewrites the change log to match
+	// our change list, dropping any partially written change at its end.
+	if err := takeSnapshot(); err != nil {
+		return err
+	}
+
+	go snapshotLoop()
+	return nil
+}
+
+// Loads the snapshot, and replays the change log on top of it.
+func loadFiles() error {
+	changeMutex.Lock()
+	defer changeMutex.Unlock()
+
+	idStr := strconv.FormatUint(uint64(Id), 10)
+
+	// Load the snapshot.
+	if file, err := os.Open(idStr + ".snapshot"); err == nil {
+		err = readSnapshot(bufio.NewReader(file))
+		file.Close()
+		if err != nil {
+			return err
+		}
+		stats.Snapshot = store.Applied()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// Replay the change log. Changes the snapshot already includes are
+	// still added to the change list, so they're available to nodes
+	// synchronising from us.
+	if file, err := os.Open(idStr + ".changes"); err == nil {
+		err = readChangeLog(bufio.NewReader(file), func(change *mmn.Change) {
+			if *change.Id < nextChange() {
+				changeList = append(changeList, appliedChange{change, time.Now()})
+				return
+			}
+			if *change.Id == nextChange() {
+				applyChange(change)
+				changeList = append(changeList, appliedChange{change, time.Now()})
+			}
+		})
+		file.Close()
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Reads a snapshot into the store, replacing its existing contents.
+// A snapshot is a Nonce line, giving the lowest change ID not applied to it,
+// followed by EntitySync and GlobalSync lines, then a Synchronized line.
+func readSnapshot(r *bufio.Reader) error {
+	store.Lock()
+	defer store.Unlock()
+
+	store.Reset()
+
+	line, err := connect.DecodeLine(r)
+	if err != nil {
+		return err
+	}
+	if line.Nonce == nil || *line.Nonce == 0 {
+		return errors.New("Snapshot missing nonce.")
+	}
+	nonce := *line.Nonce
+
+	for {
+		line, err = connect.DecodeLine(r)
+		if err == io.EOF {
+			return errors.New("Snapshot truncated.")
+		}
+		if err != nil {
+			return err
+		}
+
+		switch true {
+		case line.EntitySync != nil:
+			sync := line.EntitySync
+			store.SetEntityData(*sync.Entity, *sync.Key, string(sync.Value))
+
+		case line.GlobalSync != nil:
+			sync := line.GlobalSync
+			store.SetGlobal(*sync.Key, string(sync.Value))
+
+		case line.Synchronized != nil:
+			store.SetApplied(nonce-1, 0)
+			return nil
+
+		default:
+			return errors.New("Invalid line in snapshot.")
+		}
+	}
+}
+
+// Writes a snapshot of the store, as of the given lowest change ID not yet
+// applied. The store is read without locking, so changes applied while it's
+// being written may be reflected in it; replaying them on top is harmless.
+func writeSnapshot(w io.Writer, nonce uint64) (err error) {
+	write := func(line *mmn.Line) {
+		if err == nil {
+			_, err = w.Write(connect.EncodeLine(line))
+		}
+	}
+
+	write(connect.MakeNonce(nonce))
+
+	store.EntityRange(func(e *store.Entity) {
+		e.DataRange("", func(key, value string) {
+			write(connect.MakeEntitySync(e.Id(), key, value))
+		})
+	})
+	store.GlobalRange("", func(key, value string) {
+		write(connect.MakeGlobalSync(key, value))
+	})
+
+	write(connect.MakeSynchronized())
+
+	return
+}
+
+// Reads a change log, calling the given function for each change in it.
+// Returns nil at the end of the log.
+func readChangeLog(r *bufio.Reader, f func(change *mmn.Change)) error {
+	for {
+		line, err := connect.DecodeLine(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if line.Change == nil {
+			return errors.New("Invalid line in change log.")
+		}
+		f(line.Change)
+	}
+}
+
+// Appends an applied change to the persisted change log. A failure is
+// counted, and the change is still persisted by the next snapshot.
+// Must be called while holding the change mutex.
+func logChange(change *mmn.Change) {
+	if changeLog == nil {
+		return
+	}
+
+	if _, err := changeLog.Write(connect.EncodeLine(connect.MakeChange(change))); err != nil {
+		stats.PersistFailures++
+	}
+}
+
+// Writes a new change log containing the given changes, to be swapped in for
+// the current one by swapChangeLog.
+func writeChangeLog(changes []appliedChange) (err error) {
+	idStr := strconv.FormatUint(uint64(Id), 10)
+
+	file, err := os.Create(idStr + ".changes.tmp")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	for _, c := range changes {
+		if _, err = w.Write(connect.EncodeLine(connect.MakeChange(c.change))); err != nil {
+			return err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// Replaces the persisted change log with the one written by writeChangeLog,
+// first appending the changes applied since the given one, which it lacks.
+// Changes no longer in the change list are either covered by the latest
+// snapshot or have been expired, so this is safe once a snapshot exists.
+// Must be called while holding the change mutex.
+func swapChangeLog(after uint64) error {
+	idStr := strconv.FormatUint(uint64(Id), 10)
+
+	file, err := os.OpenFile(idStr+".changes.tmp", os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	for _, c := range changeList {
+		if *c.change.Id <= after {
+			continue
+		}
+		if _, err = file.Write(connect.EncodeLine(connect.MakeChange(c.change))); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	file.Close()
+
+	if err = os.Rename(idStr+".changes.tmp", idStr+".changes"); err != nil {
+		return err
+	}
+	if changeLog != nil {
+		changeLog.Close()
+	}
+	changeLog, err = os.OpenFile(idStr+".changes", os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+// Take a snapshot of the store, then truncate the change log.
+// The change mutex is only held briefly, not while writing files, so changes
+// keep being applied meanwhile. Must not be called while holding it.
+func takeSnapshot() (err error) {
+	idStr := strconv.FormatUint(uint64(Id), 10)
+
+	// Keep the changes from the snapshot's nonce until the change log
+	// has been rewritten, so they're in it. A nil node pins for us.
+	changeMutex.Lock()
+	nonce := nextChange()
+	pin(nil, nonce)
+	changeMutex.Unlock()
+
+	defer func() {
+		changeMutex.Lock()
+		unpin(nil)
+		if err != nil {
+			stats.PersistFailures++
+		}
+		changeMutex.Unlock()
+	}()
+
+	file, err := os.Create(idStr + ".snapshot.tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	if err = writeSnapshot(w, nonce); err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = os.Rename(idStr+".snapshot.tmp", idStr+".snapshot")
+	}
+	if err != nil {
+		return err
+	}
+
+	// Write the change log from the changes listed now, then add any
+	// applied while we were writing it, when swapping it in.
+	changeMutex.Lock()
+	stats.Snapshots++
+	stats.Snapshot = nonce - 1
+	trimChangeList()
+	changes := make([]appliedChange, len(changeList))
+	copy(changes, changeList)
+	changeMutex.Unlock()
+
+	if err = writeChangeLog(changes); err != nil {
+		return err
+	}
+	var last uint64
+	if len(changes) != 0 {
+		last = *changes[len(changes)-1].change.Id
+	}
+
+	changeMutex.Lock()
+	err = swapChangeLog(last)
+	changeMutex.Unlock()
+	return err
+}
+
+// Takes a snapshot every SnapshotInterval, if anything has changed since the
+// last one. Failures are counted in the retention statistics, and retried at
+// the next interval.
+func snapshotLoop() {
+	for {
+		time.Sleep(SnapshotInterval)
+
+		changeMutex.Lock()
+		changed := stats.Snapshot != store.Applied()
+		if !changed {
+			trimChangeList()
+		}
+		changeMutex.Unlock()
+
+		if changed {
+			takeSnapshot()
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package logic
+
+import "errors"
+import "sync"
+import "time"
+
+import "oddcomm/src/core/connect"
+import "oddcomm/src/core/store"
+
+// How long to wait for the leader to answer a read index request.
+var ReadIndexTimeout = 5 * time.Second
+
+// Held while using the read ID counter or outstanding reads.
+var readMutex sync.Mutex
+
+// The last read ID generated.
+var lastRead uint64
+
+// Outstanding read index requests, keyed by read ID.
+var reads = make(map[uint64]chan readResult)
+
+// The answer to a read index request.
+type readResult struct {
+	change uint64 // Latest committed change ID.
+	err    error  // Error, if the request could not be made.
+}
+
+
+func init() {
+	store.ReadIndex = readIndex
+}
+
+// Returns the latest change ID committed by the network, asking the leader.
+// Used by the store for linearizable reads.
+//
+// As with change requests, nodes which can't be asked are added to an ignore
+// list and the candidate leader chosen again, so reads go to the lowest node
+// we can reach.
+func readIndex() (uint64, error) {
+	ignore := make(map[uint16]bool)
+	for {
+		leader := candidateLeader(ignore)
+		if leader == nil {
+			return 0, errors.New("No reachable leader.")
+		}
+		if leader == Me {
+			return committed(), nil
+		}
+
+		change, err := leader.askReadIndex()
+		if err == nil {
+			return change, nil
+		}
+		ignore[leader.Id] = true
+	}
+}
+
+// Returns the candidate leader node. No leader is elected yet, so this is
+// the node with the lowest ID not in the given ignore list, as with no known
+// leader. Nil if every node is ignored.
+func candidateLeader(ignore map[uint16]bool) *Node {
+	var lowest *Node
+	for _, n := range Nodes {
+		if ignore[n.Id] {
+			continue
+		}
+		if lowest == nil || n.Id < lowest.Id {
+			lowest = n
+		}
+	}
+	return lowest
+}
+
+// Asks the node for the latest change ID committed by the network.
+// Fails at once if we aren't synchronised with them.
+func (n *Node) askReadIndex() (uint64, error) {
+	readMutex.Lock()
+	lastRead++
+	read := lastRead
+	result := make(chan readResult, 1)
+	reads[read] = result
+	readMutex.Unlock()
+
+	// The node's goroutine sends the request, failing it at once if we
+	// aren't synchronised with them.
+	select {
+	case n.read <- read:
+	default:
+		answerRead(read, 0, errors.New("Too many reads waiting for leader."))
+	}
+
+	select {
+	case r := <-result:
+		return r.change, r.err
+
+	case <-time.After(ReadIndexTimeout):
+		readMutex.Lock()
+		delete(reads, read)
+		readMutex.Unlock()
+		return 0, errors.New("Timed out waiting for leader.")
+	}
+}
+
+// Answers an outstanding read index request, if it is still waiting.
+func answerRead(read, change uint64, err error) {
+	readMutex.Lock()
+	result := reads[read]
+	delete(reads, read)
+	readMutex.Unlock()
+
+	if result != nil {
+		result <- readResult{change, err}
+	}
+}
+
+// Returns the highest change ID we know to be committed; every change applied,
+// and any queued changes directly following them.
+func committed() uint64 {
+	changeMutex.Lock()
+	defer changeMutex.Unlock()
+
+	id := store.Applied()
+	for changeQueue[id+1] != nil {
+		id++
+	}
+	return id
+}
+
+func (n *Node) receiveReadIndexRequest(read uint64) {
+
+	// Read index requests are only accepted once synchronised.
+	if n.conn.State != connect.ConnStateNormal {
+		n.conn.Close()
+		return
+	}
+
+	n.conn.WriteLine(connect.MakeReadIndex(read, committed()))
+}
+
+// Sends a read index request to the node, or fails it if we don't have a
+// synchronised connection to them, rather than queueing it.
+// Must be run from the node's goroutine.
+func (n *Node) sendReadIndexRequest(read uint64) {
+	if n.conn == nil || n.conn.State != connect.ConnStateNormal {
+		answerRead(read, 0, errors.New("Leader unreachable."))
+		return
+	}
+
+	if err := n.conn.WriteLine(connect.MakeReadIndexRequest(read)); err != nil {
+		n.conn.Close()
+		answerRead(read, 0, errors.New("Leader unreachable."))
+	}
+}
+
+func (n *Node) receiveReadIndex(read, change uint64) {
+
+	// Read index replies are only accepted once synchronised.
+	if n.conn.State != connect.ConnStateNormal {
+		n.conn.Close()
+		return
+	}
+
+	answerRead(read, change, nil)
+}
@@ -0,0 +1,81 @@
+package logic
+
+import "errors"
+import "testing"
+
+import "oddcomm/src/core/store"
+
+// Starts a goroutine standing in for an unreachable node's, failing every read
+// index request sent to it. Returns the node.
+func unreachableNode(id uint16) *Node {
+	n := &Node{Id: id, read: make(chan uint64, 10)}
+	go func() {
+		for read := range n.read {
+			answerRead(read, 0, errors.New("Leader unreachable."))
+		}
+	}()
+	return n
+}
+
+func TestCandidateLeader(t *testing.T) {
+	oldNodes := Nodes
+	defer func() { Nodes = oldNodes }()
+
+	Nodes = []*Node{{Id: 3}, {Id: 1}, {Id: 2}}
+
+	tests := []struct {
+		ignore []uint16
+		leader uint16
+	}{
+		{nil, 1},
+		{[]uint16{1}, 2},
+		{[]uint16{1, 2}, 3},
+		{[]uint16{2}, 1},
+		{[]uint16{1, 2, 3}, 0},
+	}
+
+	for _, test := range tests {
+		ignore := make(map[uint16]bool)
+		for _, id := range test.ignore {
+			ignore[id] = true
+		}
+
+		var id uint16
+		if leader := candidateLeader(ignore); leader != nil {
+			id = leader.Id
+		}
+		if id != test.leader {
+			t.Errorf("candidateLeader(%v) = %d, want %d", test.ignore, id, test.leader)
+		}
+	}
+}
+
+func TestReadIndexUnreachable(t *testing.T) {
+	oldId, oldNodes, oldMe := Id, Nodes, Me
+	defer func() { Id, Nodes, Me = oldId, oldNodes, oldMe }()
+
+	// With node 1 down, we're the lowest reachable node, and answer
+	// ourselves.
+	Id = 2
+	Me = &Node{Id: 2}
+	node1, node3 := unreachableNode(1), unreachableNode(3)
+	defer close(node1.read)
+	defer close(node3.read)
+	Nodes = []*Node{node1, Me, node3}
+
+	change, err := readIndex()
+	if err != nil {
+		t.Fatalf("readIndex() failed with node 1 down: %s", err)
+	}
+	if change != store.Applied() {
+		t.Errorf("readIndex() = %d, want %d", change, store.Applied())
+	}
+
+	// With every other node down too, there's no one to ask.
+	Id = 4
+	Me = nil
+	Nodes = []*Node{node1}
+	if _, err := readIndex(); err == nil {
+		t.Errorf("readIndex() succeeded with every node down")
+	}
+}
@@ -0,0 +1,88 @@
+package logic
+
+import "strconv"
+
+import "oddcomm/src/core/connect"
+import "oddcomm/src/core/store"
+
+// Called once for each recipient of a relayed message on this node.
+// Messages are dropped if unset. Must be set before Initialize.
+var Deliver func(source, target, recipient uint64, kind string, body []byte)
+
+
+// Relay sends a message from the source entity to the target entity, and to
+// every entity attached to it, following attachments transitively. Each such
+// entity with a "node" key receives it on that node.
+//
+// Relaying is best-effort; messages to nodes we aren't synchronised with, or
+// which are too far behind, are dropped rather than queued. Messages from one
+// caller arrive at each node in the order they were relayed.
+func Relay(source, target uint64, kind string, body []byte) {
+
+	// Find every recipient, grouped by the node they are on.
+	recipients := make(map[uint16][]uint64)
+	visited := make(map[uint64]bool)
+	var walk func(id uint64)
+	walk = func(id uint64) {
+		if visited[id] {
+			return
+		}
+		visited[id] = true
+
+		e := store.GetEntity(id)
+		if e == nil {
+			return
+		}
+
+		if node, err := strconv.ParseUint(e.Data("node"), 10, 16); err == nil {
+			recipients[uint16(node)] = append(recipients[uint16(node)], id)
+		}
+
+		e.DataRange("attach ", func(key, value string) {
+			attached, err := strconv.ParseUint(key[len("attach "):], 10, 64)
+			if err == nil {
+				walk(attached)
+			}
+		})
+	}
+	walk(target)
+
+	// Send one line to each node, delivering directly to our own
+	// recipients.
+	for id, list := range recipients {
+		if id == Id {
+			deliver(source, target, list, kind, body)
+			continue
+		}
+
+		// Don't wait for a busy node; drop the message instead.
+		if n := GetNode(id); n != nil {
+			select {
+			case n.relay <- connect.MakeMessage(source, target, list, kind, body):
+			default:
+			}
+		}
+	}
+}
+
+// Deliver a message to each of the given recipients on this node.
+func deliver(source, target uint64, recipients []uint64, kind string, body []byte) {
+	if Deliver == nil {
+		return
+	}
+
+	for _, recipient := range recipients {
+		Deliver(source, target, recipient, kind, body)
+	}
+}
+
+func (n *Node) receiveMessage(source, target uint64, recipients []uint64, kind string, body []byte) {
+
+	// Messages are only accepted once synchronised.
+	if n.conn.State != connect.ConnStateNormal {
+		n.conn.Close()
+		return
+	}
+
+	deliver(source, target, recipients, kind, body)
+}
@@ -0,0 +1,111 @@
+package logic
+
+import "strconv"
+import "testing"
+
+import "oddcomm/src/core/connect/mmn"
+import "oddcomm/src/core/store"
+
+// Sets up a channel, entity 100, with a member on this node (node 1), two on
+// node 3, and one on node 4, which is too busy to take any messages. Returns
+// the relay channels of nodes 3 and 4, and a function restoring the old state.
+func relayNetwork() (node3, node4 chan *mmn.Line, restore func()) {
+	oldId, oldNodes, oldMe, oldDeliver := Id, Nodes, Me, Deliver
+	restore = func() {
+		Id, Nodes, Me, Deliver = oldId, oldNodes, oldMe, oldDeliver
+		store.Lock()
+		store.Reset()
+		store.Unlock()
+	}
+
+	node3 = make(chan *mmn.Line, 10)
+	node4 = make(chan *mmn.Line)
+
+	Id = 1
+	Me = &Node{Id: 1}
+	Nodes = []*Node{Me, {Id: 3, relay: node3}, {Id: 4, relay: node4}}
+
+	store.Lock()
+	store.Reset()
+	store.SetEntityData(100, "name", "test")
+	for user, node := range map[uint64]string{1: "1", 2: "3", 3: "3", 4: "4"} {
+		store.SetEntityData(user, "node", node)
+		store.SetEntityData(100, "attach "+strconv.FormatUint(user, 10), "1")
+	}
+
+	// An attachment back to the channel, which must not be followed twice.
+	store.SetEntityData(2, "attach 100", "1")
+	store.Unlock()
+
+	return node3, node4, restore
+}
+
+func TestRelayChannel(t *testing.T) {
+	node3, node4, restore := relayNetwork()
+	defer restore()
+
+	var local []uint64
+	Deliver = func(source, target, recipient uint64, kind string, body []byte) {
+		if source != 1 || target != 100 || kind != "PRIVMSG" || string(body) != "hello" {
+			t.Errorf("delivered %s %q from %d to %d, want PRIVMSG \"hello\" from 1 to 100", kind, body, source, target)
+		}
+		local = append(local, recipient)
+	}
+
+	Relay(1, 100, "PRIVMSG", []byte("hello"))
+
+	// Our own member is delivered to directly.
+	if len(local) != 1 || local[0] != 1 {
+		t.Errorf("delivered locally to %v, want [1]", local)
+	}
+
+	// Node 3 is sent one line, for both its members.
+	select {
+	case line := <-node3:
+		m := line.Message
+		recipients := make(map[uint64]bool)
+		for _, r := range m.Recipients {
+			recipients[r] = true
+		}
+		if *m.Source != 1 || *m.Target != 100 || *m.Type != "PRIVMSG" ||
+			string(m.Body) != "hello" || len(m.Recipients) != 2 ||
+			!recipients[2] || !recipients[3] {
+			t.Errorf("node 3 was sent %v, want PRIVMSG from 1 to 100 for 2 and 3", m)
+		}
+	default:
+		t.Fatalf("node 3 was sent nothing")
+	}
+	select {
+	case line := <-node3:
+		t.Errorf("node 3 was sent a second line: %v", line.Message)
+	default:
+	}
+
+	// Node 4 is busy, so its line is dropped rather than waited for.
+	select {
+	case line := <-node4:
+		t.Errorf("busy node 4 was sent %v", line.Message)
+	default:
+	}
+}
+
+func TestRelayUser(t *testing.T) {
+	node3, _, restore := relayNetwork()
+	defer restore()
+
+	Deliver = func(source, target, recipient uint64, kind string, body []byte) {
+		t.Errorf("delivered locally to %d, want only node 3", recipient)
+	}
+
+	Relay(1, 3, "NOTICE", []byte("hi"))
+
+	select {
+	case line := <-node3:
+		m := line.Message
+		if *m.Target != 3 || *m.Type != "NOTICE" || len(m.Recipients) != 1 || m.Recipients[0] != 3 {
+			t.Errorf("node 3 was sent %v, want NOTICE to 3 for 3", m)
+		}
+	default:
+		t.Fatalf("node 3 was sent nothing")
+	}
+}
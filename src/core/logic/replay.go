@@ -0,0 +1,90 @@
+package logic
+
+import "bufio"
+import "io"
+import "os"
+
+import "oddcomm/src/core/connect/mmn"
+import "oddcomm/src/core/store"
+
+
+// ReplayTo loads the store from the given snapshot file, if it exists, then
+// applies changes from the given change log file in order, stopping after the
+// given change ID; zero applies every change. An empty change log file name
+// applies none. Returns the ID of the last change applied, which is below the
+// given change ID if the log ends first, and above it if the snapshot is.
+//
+// Nothing is persisted and no other node is involved; this is for inspecting
+// persisted state, and must not be used on a running node.
+func ReplayTo(snapshot, changes string, upto uint64) (uint64, error) {
+	err := Replay(snapshot, changes, func(*mmn.Change) bool {
+		return upto == 0 || nextChange() <= upto
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return store.Applied(), nil
+}
+
+// Replay loads the store as ReplayTo does, calling f once the snapshot is
+// loaded with a nil change, then again after applying each change, with that
+// change. The store may be read from f, and holds the state as of the change.
+// The replay stops if f returns false.
+func Replay(snapshot, changes string, f func(change *mmn.Change) bool) error {
+	store.Lock()
+	store.Reset()
+	store.Unlock()
+
+	if file, err := os.Open(snapshot); err == nil {
+		err = readSnapshot(bufio.NewReader(file))
+		file.Close()
+		if err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	list, err := ReadChanges(changes)
+	if err != nil {
+		return err
+	}
+
+	if !f(nil) {
+		return nil
+	}
+	for _, change := range list {
+		if *change.Id == nextChange() {
+			applyChange(change)
+			if !f(change) {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// ReadChanges returns every change in the given change log file, in the order
+// they were logged. A partially written change at the end is ignored, as on
+// startup. A missing file has no changes.
+func ReadChanges(changes string) (list []*mmn.Change, err error) {
+	file, err := os.Open(changes)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	err = readChangeLog(bufio.NewReader(file), func(change *mmn.Change) {
+		list = append(list, change)
+	})
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+
+	return list, err
+}
@@ -9,6 +9,7 @@ import "crypto/tls"
 import "crypto/x509"
 import "io/ioutil"
 import "strconv"
+import "time"
 
 import "oddcomm/src/core/connect"
 import "oddcomm/src/core/logic"
@@ -26,6 +27,11 @@ func Initialize(id uint16) {
 		panic(err)
 	}
 
+	// Load our persisted state.
+	if err = logic.Load(); err != nil {
+		panic(err)
+	}
+
 	// Set up nodes.
 	var info *connect.ConnInfo
 
@@ -55,6 +61,28 @@ func Initialize(id uint16) {
 	logic.StartOutgoing()
 }
 
+// SetChangeRetention sets how long applied changes are kept for synchronising
+// reconnecting nodes, and the most which may be kept at once; 0 is no limit.
+// Nodes which fall further behind than this must receive a full burst.
+// Must be called before Initialize.
+func SetChangeRetention(keep time.Duration, max int) {
+	logic.ChangeListTime = keep
+	logic.ChangeListMax = max
+}
+
+// SetSnapshotInterval sets how often a snapshot of state is written, permitting
+// the persisted change log to be truncated.
+// Must be called before Initialize.
+func SetSnapshotInterval(interval time.Duration) {
+	logic.SnapshotInterval = interval
+}
+
+// RetentionStats returns statistics on the change list, including how often
+// other nodes have had to fall back to a full burst.
+func RetentionStats() logic.RetentionStats {
+	return logic.Retention()
+}
+
 // Validates incoming connection client certificates,
 // and identifies the node they are associated with,
 // then sends the new connection to that node to handle.
@@ -0,0 +1,16 @@
+package core
+
+import "oddcomm/src/core/logic"
+
+// SendMessage relays a message of the given type from the source entity to
+// the target entity, and every entity attached to it, on whichever nodes they
+// are on. Delivery is best-effort and low latency, independent of state changes.
+func SendMessage(source, target uint64, kind string, body []byte) {
+	logic.Relay(source, target, kind, body)
+}
+
+// SetMessageHandler sets the function called for each recipient on this node
+// of a relayed message. Must be called before Initialize.
+func SetMessageHandler(f func(source, target, recipient uint64, kind string, body []byte)) {
+	logic.Deliver = f
+}
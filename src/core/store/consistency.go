@@ -0,0 +1,180 @@
+package store
+
+import "errors"
+import "sync"
+import "time"
+
+// A consistency level for reads from the store.
+// Reads themselves are always lock-free reads of local state; the level
+// determines what Read waits for before letting them happen.
+type Consistency int
+
+const (
+	// Read local state as it stands. May be stale.
+	ReadLocal Consistency = iota
+
+	// Read local state once the change made by a given request ID has
+	// been applied, so the reader sees its own writes.
+	ReadMyWrites
+
+	// Read local state once every change committed at the time of the
+	// read, as confirmed with the leader, has been applied.
+	ReadLinearizable
+)
+
+// How long Read will wait for a consistency level to be met.
+var ReadTimeout = 10 * time.Second
+
+// Returns the ID of the latest change committed by the network, as known by
+// the current leader. Set by the core's logic, and used for linearizable reads.
+var ReadIndex func() (uint64, error)
+
+// How many recently applied request IDs are remembered for ReadMyWrites.
+// Older requests from a node are assumed applied if a later request from the
+// same node has since been forgotten.
+const requestMemory = 10000
+
+// Request IDs hold the ID of the node which made them in their top 16 bits,
+// followed by a nonce which that node increases with each request.
+const RequestNonceBits = 48
+
+// A reader waiting for a consistency level to be met.
+type waiter struct {
+	change  uint64    // Change ID to wait to be applied, if non-zero.
+	request uint64    // Request ID to wait to be applied, if non-zero.
+	done    chan bool // Closed once the wait is over.
+}
+
+// Held while using waiters and applied requests.
+var waitMutex sync.Mutex
+
+// Readers currently waiting.
+var waiters []*waiter
+
+// Recently applied request IDs, and the order they were applied in.
+var requests = make(map[uint64]bool)
+var requestOrder []uint64
+
+// The highest request nonce forgotten for each node. Requests from the node
+// with nonces at or below it are treated as applied.
+var requestFloors = make(map[uint16]uint64)
+
+
+// Read waits until the given consistency level is met, then calls f, which
+// may read from the store. request is the request ID of a change this reader
+// made, for ReadMyWrites, and is otherwise ignored.
+//
+// Returns an error without calling f if the level could not be met within
+// ReadTimeout.
+func Read(level Consistency, request uint64, f func()) error {
+	w := new(waiter)
+
+	switch level {
+	case ReadLocal:
+		f()
+		return nil
+
+	case ReadMyWrites:
+		w.request = request
+
+	case ReadLinearizable:
+		if ReadIndex == nil {
+			return errors.New("Linearizable reads unavailable.")
+		}
+		change, err := ReadIndex()
+		if err != nil {
+			return err
+		}
+		w.change = change
+
+	default:
+		return errors.New("Unknown consistency level.")
+	}
+
+	// If we're waiting on nothing, or already there, read now.
+	waitMutex.Lock()
+	if w.met() {
+		waitMutex.Unlock()
+		f()
+		return nil
+	}
+	w.done = make(chan bool)
+	waiters = append(waiters, w)
+	waitMutex.Unlock()
+
+	select {
+	case <-w.done:
+		f()
+		return nil
+
+	case <-time.After(ReadTimeout):
+		waitMutex.Lock()
+		for i, other := range waiters {
+			if other == w {
+				waiters = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		waitMutex.Unlock()
+		return errors.New("Timed out waiting for consistent read.")
+	}
+}
+
+// Returns whether the waiter's wait is over.
+// Must be called while holding the wait mutex.
+func (w *waiter) met() bool {
+	if w.change != 0 && Applied() < w.change {
+		return false
+	}
+	if w.request != 0 && !requestApplied(w.request) {
+		return false
+	}
+	return true
+}
+
+// Returns whether the given request has been applied, as far as we remember.
+// Must be called while holding the wait mutex.
+func requestApplied(request uint64) bool {
+	if requests[request] {
+		return true
+	}
+	node := uint16(request >> RequestNonceBits)
+	nonce := request & (1<<RequestNonceBits - 1)
+	return nonce <= requestFloors[node]
+}
+
+// Notes that the given request has been applied, and releases any readers
+// whose wait is now over.
+func wake(request uint64) {
+	waitMutex.Lock()
+	defer waitMutex.Unlock()
+
+	if request != 0 && !requests[request] {
+		requests[request] = true
+		requestOrder = append(requestOrder, request)
+		if len(requestOrder) > requestMemory {
+			forget := requestOrder[0]
+			delete(requests, forget)
+			requestOrder = requestOrder[1:]
+
+			node := uint16(forget >> RequestNonceBits)
+			nonce := forget & (1<<RequestNonceBits - 1)
+			if nonce > requestFloors[node] {
+				requestFloors[node] = nonce
+			}
+		}
+	}
+
+	remaining := waiters[:0]
+	for _, w := range waiters {
+		if w.met() {
+			close(w.done)
+		} else {
+			remaining = append(remaining, w)
+		}
+	}
+	for i := len(remaining); i < len(waiters); i++ {
+		waiters[i] = nil
+	}
+	waiters = remaining
+}
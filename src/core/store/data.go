@@ -0,0 +1,152 @@
+package store
+
+import "strconv"
+import "sync"
+import "sync/atomic"
+
+import "oddcomm/lib/trie"
+
+// Entities, keyed by their ID in decimal.
+var entities trie.Trie
+
+// The global key-value store.
+var global trie.StringTrie
+
+// Held while writing to the store. Reads do not require it.
+var mutex sync.Mutex
+
+// The ID of the last change applied to the store. Zero if none.
+var applied uint64
+
+// Represents an entity, and its key-value store.
+type Entity struct {
+	id   uint64
+	data trie.StringTrie
+}
+
+// Lock takes the store's write lock.
+// Every write to the store must be made while holding it.
+func Lock() {
+	mutex.Lock()
+}
+
+// Unlock releases the store's write lock.
+func Unlock() {
+	mutex.Unlock()
+}
+
+// GetEntity returns the entity with the given ID, or nil if none exists.
+func GetEntity(id uint64) *Entity {
+	e, _ := entities.Get(strconv.FormatUint(id, 10)).(*Entity)
+	return e
+}
+
+// EntityRange calls the given function for every entity.
+func EntityRange(f func(e *Entity)) {
+	for it := entities.Iterate(); it != nil; {
+		_, value := it.Value()
+		if e, ok := value.(*Entity); ok {
+			f(e)
+		}
+		if !it.Next() {
+			break
+		}
+	}
+}
+
+// Id returns the entity's ID.
+func (e *Entity) Id() uint64 {
+	return e.id
+}
+
+// Data returns the value of the given key on the entity, or "" if unset.
+func (e *Entity) Data(key string) string {
+	return e.data.Get(key)
+}
+
+// DataRange calls the given function for every key on the entity beginning
+// with the given prefix. A prefix of "" iterates every key.
+func (e *Entity) DataRange(prefix string, f func(key, value string)) {
+	for it := e.data.IterSub(prefix); it != nil; {
+		f(it.Value())
+		if !it.Next() {
+			break
+		}
+	}
+}
+
+// Global returns the value of the given global key, or "" if unset.
+func Global(key string) string {
+	return global.Get(key)
+}
+
+// GlobalRange calls the given function for every global key beginning with
+// the given prefix. A prefix of "" iterates every key.
+func GlobalRange(prefix string, f func(key, value string)) {
+	for it := global.IterSub(prefix); it != nil; {
+		f(it.Value())
+		if !it.Next() {
+			break
+		}
+	}
+}
+
+// Applied returns the ID of the last change applied to the store.
+func Applied() uint64 {
+	return atomic.LoadUint64(&applied)
+}
+
+
+// SetEntityData sets the given key on the given entity, creating the entity
+// if it does not exist. An empty value unsets the key.
+// Must be called while holding the write lock.
+func SetEntityData(id uint64, key, value string) {
+	e := GetEntity(id)
+	if e == nil {
+		if value == "" {
+			return
+		}
+		e = new(Entity)
+		e.id = id
+		entities.Insert(strconv.FormatUint(id, 10), e)
+	}
+
+	if value == "" {
+		e.data.Remove(key)
+	} else {
+		e.data.Insert(key, value)
+	}
+}
+
+// DeleteEntity deletes the given entity and all its keys.
+// Must be called while holding the write lock.
+func DeleteEntity(id uint64) {
+	entities.Remove(strconv.FormatUint(id, 10))
+}
+
+// SetGlobal sets the given global key. An empty value unsets the key.
+// Must be called while holding the write lock.
+func SetGlobal(key, value string) {
+	if value == "" {
+		global.Remove(key)
+	} else {
+		global.Insert(key, value)
+	}
+}
+
+// SetApplied sets the ID of the last change applied to the store, and the
+// request ID of that change, releasing readers waiting on either. A request
+// ID of zero means the change came from no known request.
+// Must be called while holding the write lock.
+func SetApplied(id, request uint64) {
+	atomic.StoreUint64(&applied, id)
+	wake(request)
+}
+
+// Reset empties the store entirely, ready to load a snapshot into it.
+// Must be called while holding the write lock.
+func Reset() {
+	entities = trie.Trie{}
+	global = trie.StringTrie{}
+	SetApplied(0, 0)
+}
@@ -7,6 +7,7 @@
 package main
 
 import "flag"
+import "time"
 
 import "oddcomm/src/core"
 //import "oddcomm/lib/persist"
@@ -14,18 +15,22 @@ import "oddcomm/src/core"
 import "oddcomm/src/client"
 import "oddcomm/src/ts6"
 
-import _     "oddcomm/modules/user/botmark"
-import _   "oddcomm/modules/client/extbans"
-import _     "oddcomm/modules/client/login"
-import _ "oddcomm/modules/client/ochanctrl"
-import _  "oddcomm/modules/client/opermode"
-import _   "oddcomm/modules/client/opflags"
-import _     "oddcomm/modules/oper/account"
-import _  "oddcomm/modules/oper/pmoverride"
-import _      "oddcomm/modules/dev/catserv"
-import _        "oddcomm/modules/dev/horde"
-import _  "oddcomm/modules/dev/testaccount"
-import _       "oddcomm/modules/dev/tmmode"
+import _      "oddcomm/modules/user/botmark"
+import _        "oddcomm/modules/user/cloak"
+import _        "oddcomm/modules/chan/flood"
+import _ "oddcomm/modules/chan/jointhrottle"
+import _    "oddcomm/modules/client/extbans"
+import _      "oddcomm/modules/client/login"
+import _  "oddcomm/modules/client/ochanctrl"
+import _   "oddcomm/modules/client/opermode"
+import _    "oddcomm/modules/client/opflags"
+import _      "oddcomm/modules/oper/account"
+import _       "oddcomm/modules/oper/filter"
+import _   "oddcomm/modules/oper/pmoverride"
+import _       "oddcomm/modules/dev/catserv"
+import _         "oddcomm/modules/dev/horde"
+import _   "oddcomm/modules/dev/testaccount"
+import _        "oddcomm/modules/dev/tmmode"
 */
 
 var stateFile = "oddcomm.state"
@@ -34,6 +39,9 @@ func main() {
 
 	// Define and parse flags.
 	id := flag.Uint("id", 0, "Set the node ID of this OddComm instance.")
+	keep := flag.Duration("changelist-time", 120*time.Second, "Set how long applied changes are kept for resynchronising nodes.")
+	max := flag.Int("changelist-max", 100000, "Set the most changes kept for resynchronising nodes; 0 for no limit.")
+	snapshot := flag.Duration("snapshot-interval", 5*time.Minute, "Set how often a snapshot of state is written.")
 	flag.Parse()
 
 	// Validate flags.
@@ -42,6 +50,8 @@ func main() {
 	}
 
 	// Start the core.
+	core.SetChangeRetention(*keep, *max)
+	core.SetSnapshotInterval(*snapshot)
 	core.Initialize(uint16(*id))
 
 	/*
@@ -0,0 +1,292 @@
+/*
+	A tool to replay a node's persisted snapshot and change log into an
+	in-memory store, for finding out why nodes' states have diverged.
+
+	Each node is given as the path prefix of its persisted files; "1" reads
+	"1.snapshot" and "1.changes". Given one node, prints its state at the
+	change ID given with -at, or after every change. Given two, prints the
+	first change ID at which their states differ, and the differences.
+*/
+package main
+
+import "flag"
+import "fmt"
+import "os"
+import "sort"
+
+import "oddcomm/src/core/connect/mmn"
+import "oddcomm/src/core/logic"
+import "oddcomm/src/core/store"
+
+func main() {
+
+	// Define and parse flags.
+	at := flag.Uint64("at", 0, "Set the change ID to show state at; 0 for the last.")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-at id] node [other node]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	switch flag.NArg() {
+	case 1:
+		show(flag.Arg(0), *at)
+	case 2:
+		diff(flag.Arg(0), flag.Arg(1))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// Prints the state of a node at the given change ID.
+func show(node string, at uint64) {
+	s, applied := replay(node, at)
+	if at != 0 && applied != at {
+		fail("%s: state at change %d unavailable; reached %d.", node, at, applied)
+	}
+
+	fmt.Printf("State of %s at change %d:\n", node, applied)
+	keys := make([]string, 0, len(s))
+	for key := range s {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("%s = %q\n", key, s[key])
+	}
+}
+
+// Prints the first change ID at which two nodes' states differ.
+func diff(a, b string) {
+
+	// Find the span of change IDs both nodes' persisted state covers.
+	startA, endA := span(a)
+	startB, endB := span(b)
+	start := startA
+	if startB > start {
+		start = startB
+	}
+	end := endA
+	if endB < end {
+		end = endB
+	}
+	if start > end {
+		fail("%s and %s have no change ID in common; %s covers %d to %d, %s covers %d to %d.",
+			a, b, a, startA, endA, b, startB, endB)
+	}
+
+	// Replay each node once, then step both states forward a change at a
+	// time, comparing only the keys each change touched.
+	stateA, deltasA, changesA := track(a, start, end)
+	stateB, deltasB, changesB := track(b, start, end)
+
+	// If they differ at the first common change ID, that's all we can say.
+	if differ(a, b, stateA, stateB, nil) {
+		fmt.Printf("States first differ at or before change %d, the earliest both cover.\n", start)
+		return
+	}
+
+	for id := start + 1; id <= end; id++ {
+		keys := make(map[string]bool)
+		for key, value := range deltasA[id] {
+			stateA.set(key, value)
+			keys[key] = true
+		}
+		for key, value := range deltasB[id] {
+			stateB.set(key, value)
+			keys[key] = true
+		}
+
+		if differ(a, b, stateA, stateB, keys) {
+			fmt.Printf("States first differ at change %d.\n", id)
+			fmt.Printf("%s applied: %s\n", a, changesA[id])
+			fmt.Printf("%s applied: %s\n", b, changesB[id])
+			return
+		}
+	}
+
+	fmt.Printf("States do not differ between changes %d and %d.\n", start, end)
+	if endA != endB {
+		fmt.Printf("%s has changes up to %d, %s up to %d.\n", a, endA, b, endB)
+	}
+}
+
+// Returns whether two states differ, printing the differences if so. If keys
+// is non-nil, only those keys are compared.
+func differ(a, b string, stateA, stateB state, keys map[string]bool) bool {
+	if keys == nil {
+		keys = make(map[string]bool)
+		for key := range stateA {
+			keys[key] = true
+		}
+		for key := range stateB {
+			keys[key] = true
+		}
+	}
+
+	var differing []string
+	for key := range keys {
+		if stateA[key] != stateB[key] {
+			differing = append(differing, key)
+		}
+	}
+	sort.Strings(differing)
+
+	for _, key := range differing {
+		fmt.Printf("%s: %s = %q, %s = %q\n", key, a, stateA[key], b, stateB[key])
+	}
+
+	return len(differing) != 0
+}
+
+// A store's state, as "entity <id> <key>" and "global <key>" names, mapped
+// to their values.
+type state map[string]string
+
+// Sets a name in the state; an empty value removes it.
+func (s state) set(name, value string) {
+	if value == "" {
+		delete(s, name)
+	} else {
+		s[name] = value
+	}
+}
+
+// Returns the first and last change IDs a node's persisted state covers.
+func span(node string) (first, last uint64) {
+	first, err := logic.ReplayTo(node+".snapshot", "", 0)
+	if err != nil {
+		fail("%s: %s", node, err)
+	}
+	last, err = logic.ReplayTo(node+".snapshot", node+".changes", 0)
+	if err != nil {
+		fail("%s: %s", node, err)
+	}
+	return
+}
+
+// Replays a node's persisted state once, returning its state at the given
+// start change ID, the names each later change up to the end changed, mapped
+// to their new values, and the changes themselves, keyed by change ID.
+func track(node string, start, end uint64) (initial state, deltas map[uint64]state, changes map[uint64]*mmn.Change) {
+	deltas = make(map[uint64]state)
+	changes = make(map[uint64]*mmn.Change)
+
+	// The current state of each entity, for finding what changes changed.
+	entities := make(map[uint64]map[string]string)
+
+	err := logic.Replay(node+".snapshot", node+".changes", func(change *mmn.Change) bool {
+		id := store.Applied()
+		if id < start {
+			return true
+		}
+
+		if initial == nil {
+			initial = current()
+			store.EntityRange(func(e *store.Entity) {
+				entities[e.Id()] = entityData(e.Id())
+			})
+			return id < end
+		}
+
+		delta := make(state)
+		for _, entry := range change.Changes {
+			if entry.Target == nil {
+				delta["global "+*entry.Key] = store.Global(*entry.Key)
+			} else {
+				refresh(entities, *entry.Target, delta)
+			}
+		}
+		deltas[id] = delta
+		changes[id] = change
+
+		return id < end
+	})
+	if err != nil {
+		fail("%s: %s", node, err)
+	}
+
+	return
+}
+
+// Records the names of an entity which have changed in the store since it was
+// last refreshed in the given delta, updating the entity's recorded data.
+// If it has been deleted, entities it was attached to are refreshed in turn,
+// as they may have been detached or deleted with it.
+func refresh(entities map[uint64]map[string]string, id uint64, delta state) {
+	old := entities[id]
+	data := entityData(id)
+
+	prefix := fmt.Sprintf("entity %d ", id)
+	for key, value := range data {
+		if old[key] != value {
+			delta[prefix+key] = value
+		}
+	}
+	for key := range old {
+		if _, ok := data[key]; !ok {
+			delta[prefix+key] = ""
+		}
+	}
+
+	if len(data) == 0 {
+		delete(entities, id)
+	} else {
+		entities[id] = data
+	}
+
+	if old != nil && data == nil {
+		attach := fmt.Sprintf("attach %d", id)
+		for other, otherData := range entities {
+			if otherData[attach] != "" {
+				refresh(entities, other, delta)
+			}
+		}
+	}
+}
+
+// Returns an entity's data in the store, or nil if it doesn't exist.
+func entityData(id uint64) (data map[string]string) {
+	e := store.GetEntity(id)
+	if e == nil {
+		return nil
+	}
+
+	data = make(map[string]string)
+	e.DataRange("", func(key, value string) {
+		data[key] = value
+	})
+	return
+}
+
+// Replays a node's persisted state up to the given change ID, returning the
+// resulting state and the last change ID applied.
+func replay(node string, upto uint64) (state, uint64) {
+	applied, err := logic.ReplayTo(node+".snapshot", node+".changes", upto)
+	if err != nil {
+		fail("%s: %s", node, err)
+	}
+
+	return current(), applied
+}
+
+// Returns the store's current state.
+func current() state {
+	s := make(state)
+	store.EntityRange(func(e *store.Entity) {
+		e.DataRange("", func(key, value string) {
+			s[fmt.Sprintf("entity %d %s", e.Id(), key)] = value
+		})
+	})
+	store.GlobalRange("", func(key, value string) {
+		s["global "+key] = value
+	})
+	return s
+}
+
+// Prints an error and exits.
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,182 @@
+/*
+	Stores messages for users who are offline, to be delivered when they
+	next connect.
+
+	Messages are stored by account, for users logged into one who remain
+	with no client connected, and delivered to the next client to connect
+	for the account.
+
+	Stored messages are kept in global data, as
+	"offline <account> <sequence>", so they persist across restarts.
+*/
+package offline
+
+import "fmt"
+import "os"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+import "oddcomm/src/core"
+
+
+var me string = "offline"
+
+// The most messages stored for one account at once.
+var MaxMessages = 100
+
+// The most bytes of message text stored for one account at once.
+var MaxBytes = 16384
+
+// How long, in seconds, messages are kept.
+var Expiry int64 = 7 * 24 * 60 * 60
+
+
+// A stored message.
+type Message struct {
+	Source  string // Sender, as nick!ident@host.
+	Target  string // Nick the message was sent to.
+	Type    string // Message type, as passed to core message functions.
+	Message []byte // Message text.
+	Time    int64  // Time the message was stored, in seconds.
+}
+
+// Held while storing or taking messages.
+var mutex sync.Mutex
+
+// The last sequence number given to a stored message.
+var sequence int64
+
+// When expired messages were last removed for every account, in seconds.
+var lastSweep int64
+
+
+// Store stores a message from the given user to the given user, who must be
+// logged into an account, for delivery when a client next connects for it.
+// from is the sender as the target sees them, as nick!ident@host, with any
+// cloak applied. Returns an error if the account's quota is full.
+func Store(source, target *core.User, from string, message []byte, t string) os.Error {
+	account := strings.ToUpper(target.Data("account"))
+	if account == "" {
+		return os.NewError("They are not logged in, so can't be sent messages while offline.")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	now := time.Seconds()
+	if now-lastSweep >= 60*60 {
+		expire("", now)
+		lastSweep = now
+	}
+
+	queue := stored(account, now)
+	if len(queue) >= MaxMessages {
+		return os.NewError("Offline message storage for this user is full.")
+	}
+	size := len(message)
+	for _, m := range queue {
+		size += len(m.Message)
+	}
+	if size > MaxBytes {
+		return os.NewError("Offline message storage for this user is full.")
+	}
+
+	// Sequence numbers are stored times in nanoseconds, kept increasing
+	// so messages sort in the order they were stored.
+	seq := time.Nanoseconds()
+	if seq <= sequence {
+		seq = sequence + 1
+	}
+	sequence = seq
+
+	if t == "" {
+		t = "-"
+	}
+	core.Global.SetData(me, source, fmt.Sprintf("offline %s %019d", account, seq),
+		t+" "+target.Nick()+" "+from+" :"+string(message))
+
+	return nil
+}
+
+// Take removes and returns every message stored for the given account,
+// oldest first.
+func Take(account string) []*Message {
+	account = strings.ToUpper(account)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	queue := stored(account, time.Seconds())
+
+	var names []string
+	core.Global.DataRange("offline "+account+" ", func(name, _ string) {
+		names = append(names, name)
+	})
+	for _, name := range names {
+		core.Global.SetData(me, nil, name, "")
+	}
+
+	return queue
+}
+
+// Returns the unexpired messages stored for the given account, removing
+// expired ones.
+// Must be called while holding the mutex.
+func stored(account string, now int64) (queue []*Message) {
+	expire(account, now)
+
+	core.Global.DataRange("offline "+account+" ", func(name, value string) {
+		if m := parse(name, value); m != nil {
+			queue = append(queue, m)
+		}
+	})
+	return
+}
+
+// Removes expired messages stored for the given account, or every account
+// if "".
+// Must be called while holding the mutex.
+func expire(account string, now int64) {
+	prefix := "offline "
+	if account != "" {
+		prefix += account + " "
+	}
+
+	var expired []string
+	core.Global.DataRange(prefix, func(name, value string) {
+		if m := parse(name, value); m == nil || m.Time < now-Expiry {
+			expired = append(expired, name)
+		}
+	})
+	for _, name := range expired {
+		core.Global.SetData(me, nil, name, "")
+	}
+}
+
+// Parses a stored message, returning nil if it is invalid.
+func parse(name, value string) *Message {
+	names := strings.Split(name, " ", 3)
+	fields := strings.Split(value, " ", 4)
+	if len(names) != 3 || len(fields) != 4 || len(fields[3]) == 0 ||
+		fields[3][0] != ':' {
+		return nil
+	}
+
+	seq, err := strconv.Atoi64(names[2])
+	if err != nil {
+		return nil
+	}
+
+	m := new(Message)
+	m.Type = fields[0]
+	if m.Type == "-" {
+		m.Type = ""
+	}
+	m.Target = fields[1]
+	m.Source = fields[2]
+	m.Message = []byte(fields[3][1:])
+	m.Time = seq / 1e9
+	return m
+}
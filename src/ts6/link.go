@@ -11,7 +11,7 @@ import "oddcomm/lib/irc"
 
 // Handle a single (potential) server link.
 // outgoing indicates whether it is outgoing or incoming.
-func link(c *net.TCPConn, outgoing bool) {
+func link(c net.Conn, outgoing bool) {
 	errMsg := "Input Error"
 
 	serverMutex.Lock()
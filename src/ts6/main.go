@@ -5,6 +5,7 @@ package ts6
 
 import "fmt"
 import "net"
+import "strings"
 import "sync"
 
 import "oddcomm/lib/irc"
@@ -26,6 +27,13 @@ var serverMutex sync.Mutex
 // Commands added here will be called with either a server or a core.User.
 var commands = irc.NewCommandDispatcher()
 
+// Addresses to listen for server links on, and to link to on startup.
+// Addresses are a host and port, such as "127.0.0.1:3725" or "[::1]:3725",
+// or a path to a UNIX socket.
+// May only be changed before starting the subsystem.
+var Listen = []string{"127.0.0.1:3725"}
+var Connect = []string{"127.0.0.1:13725"}
+
 // Create a channel for sending messages to the subsystem's goroutine.
 var subsysMsg chan string = make(chan string)
 
@@ -42,22 +50,24 @@ func Start() (msg chan string, exit chan int) {
 
 func ts6_main(msg chan string, exit chan int) {
 
-	// No configuration, so this is fixed.
-	var addr net.TCPAddr
-	addr.IP = net.IPv4(127, 0, 0, 1)
-	addr.Port = 3725
-
-	// Start our listener.
-	l, err := net.ListenTCP("tcp4", &addr)
-	if err != nil {
-		fmt.Printf("No bind: %s\n", err)
-		exit <- 0
-	} else {
+	// Start our listeners.
+	bound := false
+	for _, addr := range Listen {
+		l, err := net.Listen(listenNetwork(addr), addr)
+		if err != nil {
+			fmt.Printf("No bind: %s\n", err)
+			continue
+		}
+		bound = true
 		go listen(l)
+	}
+	if !bound {
+		exit <- 0
+	}
 
-		// Again, no configuration.
-		addr.Port = 13725
-		c, err := net.DialTCP("tcp4", nil, &addr)
+	// Link to our configured servers.
+	for _, addr := range Connect {
+		c, err := net.Dial(listenNetwork(addr), "", addr)
 		if err != nil {
 			fmt.Printf("No connection: %s\n", err)
 		} else {
@@ -75,9 +85,9 @@ func ts6_main(msg chan string, exit chan int) {
 
 // Listen goroutine function, handling listening for one socket.
 // Owns its socket.
-func listen(l *net.TCPListener) {
+func listen(l net.Listener) {
 	for {
-		c, err := l.AcceptTCP()
+		c, err := l.Accept()
 		if err != nil {
 			core.Shutdown()
 			return
@@ -85,3 +95,12 @@ func listen(l *net.TCPListener) {
 		go link(c, false)
 	}
 }
+
+// Returns the network of the given address; "unix" for paths, "tcp" for
+// anything else.
+func listenNetwork(addr string) string {
+	if strings.HasPrefix(addr, "/") || strings.HasPrefix(addr, ".") {
+		return "unix"
+	}
+	return "tcp"
+}
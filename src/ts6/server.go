@@ -25,7 +25,7 @@ type server struct {
 // The local struct contains the state for directly linked servers.
 type local struct {
 	server                     // Embed information on this server.
-	c             *net.TCPConn // This server's connection.
+	c             net.Conn     // This server's connection.
 	authed        bool         // Whether this server has authenticated to us.
 	auth_sent     bool         // Whether we've authenticated to it.
 	burst_sent    bool         // Whether we've finished sending our burst.